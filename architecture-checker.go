@@ -0,0 +1,111 @@
+package main
+
+import (
+	"debug/elf"
+	"fmt"
+	"path"
+	"strings"
+)
+
+const FindingArchitectureMismatch = "architecture-mismatch"
+
+// elfArchitecture is what the ELF header tells about the architecture.
+type elfArchitecture struct {
+	Machine elf.Machine
+	Class   elf.Class
+	Data    elf.Data
+}
+
+// Machine, class and byte order of the objects built for each Debian
+// architecture, see dpkg-architecture(1) and cputable of dpkg.
+var debianArchitectures = map[string]elfArchitecture{
+	"amd64":          {elf.EM_X86_64, elf.ELFCLASS64, elf.ELFDATA2LSB},
+	"kfreebsd-amd64": {elf.EM_X86_64, elf.ELFCLASS64, elf.ELFDATA2LSB},
+	"x32":            {elf.EM_X86_64, elf.ELFCLASS32, elf.ELFDATA2LSB},
+	"i386":           {elf.EM_386, elf.ELFCLASS32, elf.ELFDATA2LSB},
+	"hurd-i386":      {elf.EM_386, elf.ELFCLASS32, elf.ELFDATA2LSB},
+	"kfreebsd-i386":  {elf.EM_386, elf.ELFCLASS32, elf.ELFDATA2LSB},
+	"arm64":          {elf.EM_AARCH64, elf.ELFCLASS64, elf.ELFDATA2LSB},
+	"armel":          {elf.EM_ARM, elf.ELFCLASS32, elf.ELFDATA2LSB},
+	"armhf":          {elf.EM_ARM, elf.ELFCLASS32, elf.ELFDATA2LSB},
+	"ppc64el":        {elf.EM_PPC64, elf.ELFCLASS64, elf.ELFDATA2LSB},
+	"ppc64":          {elf.EM_PPC64, elf.ELFCLASS64, elf.ELFDATA2MSB},
+	"powerpc":        {elf.EM_PPC, elf.ELFCLASS32, elf.ELFDATA2MSB},
+	"s390x":          {elf.EM_S390, elf.ELFCLASS64, elf.ELFDATA2MSB},
+	"riscv64":        {elf.EM_RISCV, elf.ELFCLASS64, elf.ELFDATA2LSB},
+	"loong64":        {elf.EM_LOONGARCH, elf.ELFCLASS64, elf.ELFDATA2LSB},
+	"mips":           {elf.EM_MIPS, elf.ELFCLASS32, elf.ELFDATA2MSB},
+	"mipsel":         {elf.EM_MIPS, elf.ELFCLASS32, elf.ELFDATA2LSB},
+	"mips64el":       {elf.EM_MIPS, elf.ELFCLASS64, elf.ELFDATA2LSB},
+	"alpha":          {elf.EM_ALPHA, elf.ELFCLASS64, elf.ELFDATA2LSB},
+	"ia64":           {elf.EM_IA_64, elf.ELFCLASS64, elf.ELFDATA2LSB},
+	"sparc64":        {elf.EM_SPARCV9, elf.ELFCLASS64, elf.ELFDATA2MSB},
+	"hppa":           {elf.EM_PARISC, elf.ELFCLASS32, elf.ELFDATA2MSB},
+	"m68k":           {elf.EM_68K, elf.ELFCLASS32, elf.ELFDATA2MSB},
+	"sh4":            {elf.EM_SH, elf.ELFCLASS32, elf.ELFDATA2LSB},
+}
+
+// Directories whose objects are not meant for the architecture of their
+// package: biarch libraries, firmware, boot loader payloads and data.
+var architectureAllowList = []string{
+	"/lib32/",
+	"/lib64/",
+	"/libx32/",
+	"/usr/lib32/",
+	"/usr/lib64/",
+	"/usr/libx32/",
+	"/lib/firmware/",
+	"/usr/lib/firmware/",
+	"/usr/lib/gcc-cross/",
+	"/usr/lib/grub/",
+	"/usr/lib/debug/",
+	"/usr/share/",
+	"/boot/",
+}
+
+// checkArchitectures compares the ELF header of every object with the
+// Architecture field of its package. Objects in Architecture: all packages
+// and objects built for another architecture are reported.
+func checkArchitectures() error {
+	objects, err := dbArchitectures()
+	if err != nil {
+		return err
+	}
+	var findings []Finding
+	for key, obj := range objects {
+		if ArchitectureAllowed(key.Path) {
+			continue
+		}
+		var architecture = key.Architecture
+		var have = elfArchitecture{elf.Machine(obj.Machine), elf.Class(obj.Class), elf.Data(obj.Data)}
+		if architecture != "all" {
+			want, known := debianArchitectures[architecture]
+			if !known || want == have {
+				continue
+			}
+		}
+		findings = append(findings, Finding{
+			ELFObjectKey: key,
+			Kind:         FindingArchitectureMismatch,
+			Subject:      fmt.Sprintf("%s %s %s", have.Machine, have.Class, have.Data),
+			Detail:       "Architecture: " + architecture,
+		})
+	}
+
+	fmt.Printf("Architectures: %d objects checked, %d findings\n", len(objects), len(findings))
+	return dbReplaceFindings([]string{FindingArchitectureMismatch}, findings)
+}
+
+// ArchitectureAllowed reports whether file lies in a directory of
+// architectureAllowList or in the sysroot of a cross toolchain, such as
+// /usr/aarch64-linux-gnu.
+func ArchitectureAllowed(file string) bool {
+	file = path.Join("/", file)
+	for _, dir := range architectureAllowList {
+		if strings.HasPrefix(file, dir) {
+			return true
+		}
+	}
+	var parts = strings.SplitN(file, "/", 4)
+	return len(parts) == 4 && parts[1] == "usr" && multiarchRegex.MatchString(parts[2])
+}
@@ -2,13 +2,63 @@ package main
 
 import (
 	"archive/tar"
+	"bufio"
+	"compress/bzip2"
 	"compress/gzip"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
-	"os/exec"
+	"path"
 	"strconv"
 	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+	"github.com/ulikunitz/xz"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+var ErrNotAnArchive = errors.New("not an ar archive")
+
+// Errors of malformed archives, wrapped by ArError.
+var (
+	ErrArHeader    = errors.New("malformed ar member header")
+	ErrArLongName  = errors.New("bad ar long member name")
+	ErrArTruncated = errors.New("truncated ar archive")
+)
+
+// Errors of .deb files which are valid archives but not valid packages,
+// see deb(5).
+var (
+	ErrDebVersion       = errors.New("unsupported deb format version")
+	ErrDebMemberOrder   = errors.New("unexpected deb member")
+	ErrDebMissingMember = errors.New("missing deb member")
+)
+
+// ArError tells where an archive is malformed. Offset is the offset of the
+// member header in the archive.
+type ArError struct {
+	Offset int64
+	Member string
+	Err    error
+}
+
+func (e *ArError) Error() string {
+	if e.Member == "" {
+		return fmt.Sprintf("%v at offset %d", e.Err, e.Offset)
+	}
+	return fmt.Sprintf("%v: %s at offset %d", e.Err, e.Member, e.Offset)
+}
+
+func (e *ArError) Unwrap() error {
+	return e.Err
+}
+
+const (
+	arMagic      = "!<arch>\n"
+	arHeaderSize = 60
+	arBSDName    = "#1/" // BSD long names precede the member data
 )
 
 type ArFileDescriptor struct {
@@ -20,56 +70,218 @@ type ArFileDescriptor struct {
 	Size      int64
 }
 
-func ArFind(input io.ReadSeeker, file string) (*ArFileDescriptor, io.Reader) {
-	input.Seek(0, io.SeekStart)
-	buf := make([]byte, 16)
-	input.Read(buf[:8])
-	if string(buf[:8]) != "!<arch>\n" {
-		log.Fatalln("corrupted format")
+// ArReader iterates over the members of an archive in a single pass over
+// its input. Member names are resolved through the GNU long name table or
+// the BSD name prefix, and the symbol tables of ar itself are skipped. Read
+// reads the current member.
+type ArReader struct {
+	input     io.Reader
+	offset    int64 // of the next header
+	longNames []byte
+	header    int64 // offset of the header of the current member
+	name      string
+	member    io.LimitedReader
+	padding   int64
+	err       error
+}
+
+// NewArReader checks the magic of the archive.
+func NewArReader(input io.Reader) (*ArReader, error) {
+	var magic = make([]byte, len(arMagic))
+	if _, err := io.ReadFull(input, magic); err != nil || string(magic) != arMagic {
+		return nil, &ArError{Err: ErrNotAnArchive}
 	}
-	for {
-		var fd ArFileDescriptor
-		_, err := input.Read(buf[:16])
-		if err == io.EOF {
+	return &ArReader{input: input, offset: int64(len(arMagic))}, nil
+}
+
+// Next skips the rest of the current member and returns the next one, or
+// io.EOF at the end of the archive. Errors are sticky.
+func (r *ArReader) Next() (*ArFileDescriptor, error) {
+	for r.err == nil {
+		var fd *ArFileDescriptor
+		fd, r.err = r.next()
+		if r.err != nil {
 			break
 		}
-		fd.Name = strings.TrimSpace(string(buf[:16]))
+		switch fd.Name {
+		case "//": // GNU long name table
+			r.longNames, r.err = ioutil.ReadAll(r)
+		case "/", "/SYM64/": // GNU symbol tables
+		case "__.SYMDEF", "__.SYMDEF SORTED", "__.SYMDEF_64", "__.SYMDEF_64 SORTED": // BSD symbol tables
+		default:
+			return fd, nil
+		}
+	}
+	return nil, r.err
+}
 
-		input.Read(buf[:12])
-		fd.Timestamp, _ = strconv.ParseInt(strings.TrimSpace(string(buf[:12])), 10, 64)
+func (r *ArReader) next() (*ArFileDescriptor, error) {
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		return nil, err
+	}
+	// The padding of the last member is sometimes left out
+	io.CopyN(ioutil.Discard, r.input, r.padding)
+	r.header, r.name, r.padding = r.offset, "", 0
+
+	var buf [arHeaderSize]byte
+	if n, err := io.ReadFull(r.input, buf[:]); n == 0 && err == io.EOF {
+		return nil, io.EOF
+	} else if err != nil {
+		return nil, r.error(ErrArTruncated)
+	}
+	fd, err := arParseHeader(buf[:])
+	if err != nil {
+		return nil, r.error(err)
+	}
+	r.name = fd.Name
+	r.offset += arHeaderSize + fd.Size + fd.Size&1
+	r.padding = fd.Size & 1
+	r.member = io.LimitedReader{R: r.input, N: fd.Size}
 
-		input.Read(buf[:6])
-		fd.Owner, _ = strconv.Atoi(strings.TrimSpace(string(buf[:6])))
+	switch {
+	case strings.HasPrefix(fd.Name, arBSDName):
+		length, err := strconv.ParseInt(fd.Name[len(arBSDName):], 10, 64)
+		if err != nil || length < 0 || length > fd.Size {
+			return nil, r.error(ErrArLongName)
+		}
+		// Read rather than allocated up front, as both sizes come from the
+		// header and the input may end well before them
+		name, err := ioutil.ReadAll(io.LimitReader(r, length))
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(name)) != length {
+			return nil, r.error(ErrArTruncated)
+		}
+		fd.Name = strings.TrimRight(string(name), "\x00")
+		fd.Size -= length
+	case fd.Name == "/", fd.Name == "//", fd.Name == "/SYM64/":
+	case strings.HasPrefix(fd.Name, "/"): // GNU long name, /123
+		offset, err := strconv.Atoi(fd.Name[1:])
+		if err != nil || offset < 0 || offset >= len(r.longNames) {
+			return nil, r.error(ErrArLongName)
+		}
+		var name = string(r.longNames[offset:])
+		if end := strings.IndexByte(name, '\n'); end != -1 {
+			name = name[:end]
+		}
+		fd.Name = strings.TrimSuffix(name, "/")
+	default:
+		fd.Name = strings.TrimSuffix(fd.Name, "/")
+	}
+	r.name = fd.Name
+	return fd, nil
+}
 
-		input.Read(buf[:6])
-		fd.Group, _ = strconv.Atoi(strings.TrimSpace(string(buf[:6])))
+// Read reads the current member. A member cut short by the end of the
+// input is an error.
+func (r *ArReader) Read(p []byte) (int, error) {
+	n, err := r.member.Read(p)
+	if err == io.EOF && r.member.N > 0 {
+		r.err = r.error(ErrArTruncated)
+		return n, r.err
+	}
+	return n, err
+}
 
-		input.Read(buf[:8])
-		t, _ := strconv.ParseUint(strings.TrimSpace(string(buf[:8])), 8, 32)
-		fd.Mode = uint32(t)
+func (r *ArReader) error(err error) error {
+	return &ArError{Offset: r.header, Member: r.name, Err: err}
+}
 
-		input.Read(buf[:10])
-		fd.Size, _ = strconv.ParseInt(strings.TrimSpace(string(buf[:10])), 10, 64)
+// arParseHeader parses a member header. Only the size is required to be
+// valid; the other fields are left blank by some writers, such as the GNU
+// long name table.
+func arParseHeader(buf []byte) (*ArFileDescriptor, error) {
+	if string(buf[58:60]) != "`\n" {
+		return nil, ErrArHeader
+	}
+	var fd ArFileDescriptor
+	var err error
+	fd.Name = strings.TrimSpace(string(buf[0:16]))
+	fd.Timestamp, _ = strconv.ParseInt(strings.TrimSpace(string(buf[16:28])), 10, 64)
+	fd.Owner, _ = strconv.Atoi(strings.TrimSpace(string(buf[28:34])))
+	fd.Group, _ = strconv.Atoi(strings.TrimSpace(string(buf[34:40])))
+	t, _ := strconv.ParseUint(strings.TrimSpace(string(buf[40:48])), 8, 32)
+	fd.Mode = uint32(t)
+	fd.Size, err = strconv.ParseInt(strings.TrimSpace(string(buf[48:58])), 10, 64)
+	if err != nil || fd.Size < 0 || fd.Name == "" {
+		return nil, ErrArHeader
+	}
+	return &fd, nil
+}
 
-		input.Read(buf[:2])
-		if string(buf[:2]) != "`\n" {
-			return nil, nil
+// ArWalk calls walk with every member of the archive, in a single pass over
+// input.
+func ArWalk(input io.Reader, walk func(fd *ArFileDescriptor, member io.Reader)) error {
+	ar, err := NewArReader(input)
+	if err != nil {
+		return err
+	}
+	for {
+		fd, err := ar.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		walk(fd, ar)
+	}
+}
+
+// Members of a binary package, in the order they must appear in.
+const (
+	debBinaryMember  = "debian-binary"
+	debControlMember = "control.tar"
+	debDataMember    = "data.tar"
+)
+
+// DebFind finds the control.tar or the data.tar member of a binary package,
+// whatever its compression suffix. On the way the members are checked as
+// dpkg-deb does: debian-binary of format 2.x first, then control.tar and
+// data.tar. Members whose names start with an underscore may come between
+// them.
+func DebFind(input io.ReadSeeker, member string) (*ArFileDescriptor, io.Reader, error) {
+	if _, err := input.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+	ar, err := NewArReader(input)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, expected := range []string{debBinaryMember, debControlMember, debDataMember} {
+		fd, err := ar.Next()
+		for expected != debBinaryMember && err == nil && strings.HasPrefix(fd.Name, "_") {
+			fd, err = ar.Next()
+		}
+		if err == io.EOF {
+			return nil, nil, &ArError{Offset: ar.offset, Member: expected, Err: ErrDebMissingMember}
+		} else if err != nil {
+			return nil, nil, err
+		}
+		if fd.Name != expected && !strings.HasPrefix(fd.Name, expected+".") {
+			return nil, nil, ar.error(ErrDebMemberOrder)
+		}
+		if expected == debBinaryMember {
+			version, err := ioutil.ReadAll(io.LimitReader(ar, 16))
+			if err != nil {
+				return nil, nil, err
+			}
+			if !strings.HasPrefix(string(version), "2.") || !strings.Contains(string(version), "\n") {
+				return nil, nil, ar.error(ErrDebVersion)
+			}
 		}
-		if strings.HasPrefix(fd.Name, file) {
-			return &fd, input
+		if expected == member {
+			return fd, ar, nil
 		}
-		offset := fd.Size
-		offset += offset & 1
-		input.Seek(offset, io.SeekCurrent)
 	}
-	return nil, nil
+	return nil, nil, ar.error(ErrDebMissingMember)
 }
 
 func TarFind(input io.Reader, file string) (*tar.Header, io.Reader) {
 	tarReader := tar.NewReader(input)
 	for {
 		h, err := tarReader.Next()
-		if err == io.EOF {
+		if err != nil {
 			return nil, nil
 		}
 		if h.Name == file {
@@ -78,38 +290,164 @@ func TarFind(input io.Reader, file string) (*tar.Header, io.Reader) {
 	}
 }
 
-func Decompress(file string, input io.Reader) io.ReadCloser {
-	if strings.HasSuffix(file, ".gz") {
-		return ioutil.NopCloser(GzDecompress(input))
+// Compression formats of the members of a .deb, as recorded in the
+// repository table.
+const (
+	CompressionNone  = "none"
+	CompressionGzip  = "gzip"
+	CompressionXz    = "xz"
+	CompressionZstd  = "zstd"
+	CompressionBzip2 = "bzip2"
+	CompressionLzma  = "lzma"
+)
+
+var ErrUnknownCompression = errors.New("unknown compression")
+
+var compressionSuffixes = map[string]string{
+	".tar":  CompressionNone,
+	".gz":   CompressionGzip,
+	".xz":   CompressionXz,
+	".zst":  CompressionZstd,
+	".bz2":  CompressionBzip2,
+	".lzma": CompressionLzma,
+}
+
+var compressionMagics = []struct {
+	Magic       string
+	Compression string
+}{
+	{"\x1f\x8b", CompressionGzip},
+	{"\xfd7zXZ\x00", CompressionXz},
+	{"\x28\xb5\x2f\xfd", CompressionZstd},
+	{"BZh", CompressionBzip2},
+	{"\x5d\x00\x00", CompressionLzma},
+}
+
+// ReadAheadSize is the compressed size from which xz members are decoded
+// in a goroutine of their own, ahead of the reader, so that decoding and
+// scanning the contents run in parallel. Zero disables it.
+var ReadAheadSize int64 = 32 * 1024 * 1024
+
+// ParallelSize is the compressed size from which gzip and multi-block xz
+// members are decoded by several goroutines, so that the few largest
+// packages do not keep a full scan waiting. Zero disables it.
+var ParallelSize int64 = 64 * 1024 * 1024
+
+// Blocks of parallel gzip decoding, see pgzip.NewReaderN.
+const (
+	pgzipBlockSize = 1024 * 1024
+	pgzipBlocks    = 8
+)
+
+// Decompress selects the decompressor by the suffix of the member name, or
+// by the magic bytes of the stream if the suffix is unknown. Streams without
+// any known magic are taken as uncompressed. It returns the compression
+// format found as well. size is the size of the member, or -1 if unknown.
+func Decompress(file string, size int64, input io.Reader) (io.ReadCloser, string, error) {
+	compression, known := compressionSuffixes[path.Ext(file)]
+	if !known {
+		buffered := bufio.NewReader(input)
+		compression = CompressionFromMagic(buffered)
+		input = buffered
+	}
+	var parallel = ParallelSize != 0 && size >= ParallelSize
+	var reader io.ReadCloser
+	var err error
+	switch {
+	case parallel && compression == CompressionGzip:
+		reader, err = ParallelGzDecompress(input)
+	case parallel && compression == CompressionXz:
+		reader, err = ParallelXzDecompress(input, NumCPU)
+	default:
+		reader, err = NewDecompressor(compression, input)
+		if err == nil && compression == CompressionXz && ReadAheadSize != 0 && size >= ReadAheadSize {
+			reader = NewReadAhead(reader)
+		}
+	}
+	return reader, compression, err
+}
+
+// CompressionFromMagic peeks at the beginning of the stream.
+func CompressionFromMagic(input *bufio.Reader) string {
+	for _, magic := range compressionMagics {
+		if head, _ := input.Peek(len(magic.Magic)); string(head) == magic.Magic {
+			return magic.Compression
+		}
 	}
-	if strings.HasSuffix(file, ".xz") {
+	return CompressionNone
+}
+
+func NewDecompressor(compression string, input io.Reader) (io.ReadCloser, error) {
+	switch compression {
+	case CompressionNone:
+		return ioutil.NopCloser(input), nil
+	case CompressionGzip:
+		return GzDecompress(input)
+	case CompressionXz:
 		return XzDecompress(input)
+	case CompressionLzma:
+		return LzmaDecompress(input)
+	case CompressionZstd:
+		return ZstdDecompress(input)
+	case CompressionBzip2:
+		return ioutil.NopCloser(bzip2.NewReader(input)), nil
 	}
-	return nil
+	return nil, ErrUnknownCompression
 }
 
-func GzDecompress(input io.Reader) io.Reader {
+func GzDecompress(input io.Reader) (io.ReadCloser, error) {
 	r, err := gzip.NewReader(input)
 	if err != nil {
-		log.Fatalln(err)
+		return nil, err
+	}
+	return r, nil
+}
+
+// ParallelGzDecompress inflates ahead of the reader in blocks. Deflate
+// itself is sequential, but the CRC is checked and the output is buffered
+// in goroutines of their own.
+func ParallelGzDecompress(input io.Reader) (io.ReadCloser, error) {
+	r, err := pgzip.NewReaderN(input, pgzipBlockSize, pgzipBlocks)
+	if err != nil {
+		return nil, err
 	}
-	return r
+	return pgzipReader{r}, nil
 }
 
-func XzDecompress(input io.Reader) io.ReadCloser {
-	var xzReader, w = io.Pipe()
+// pgzipReader hides the WriteTo of pgzip.Reader from io.Copy, as it slices
+// past the block it has returned once Read was called before.
+type pgzipReader struct {
+	r *pgzip.Reader
+}
+
+func (r pgzipReader) Read(p []byte) (int, error) {
+	return r.r.Read(p)
+}
+
+func (r pgzipReader) Close() error {
+	return r.r.Close()
+}
+
+func ZstdDecompress(input io.Reader) (io.ReadCloser, error) {
+	r, err := zstd.NewReader(input, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return r.IOReadCloser(), nil
+}
 
-	var xzCmd = exec.Command("xz", "-d")
-	xzCmd.Stdin = input
-	xzCmd.Stdout = w
+func XzDecompress(input io.Reader) (io.ReadCloser, error) {
+	r, err := xz.NewReader(input)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(r), nil
+}
 
-	err := xzCmd.Start()
+func LzmaDecompress(input io.Reader) (io.ReadCloser, error) {
+	r, err := lzma.NewReader(input)
 	if err != nil {
-		log.Fatalln(err)
+		return nil, err
 	}
-	go func() {
-		xzCmd.Wait()
-		w.Close()
-	}()
-	return xzReader
+	return ioutil.NopCloser(r), nil
 }
@@ -3,14 +3,18 @@ package main
 import (
 	"archive/tar"
 	"crypto/sha256"
+	"debug/elf"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -28,21 +32,58 @@ type FileInfo struct {
 }
 
 type PackageInfo struct {
-	Package  string
-	Version  string
-	Filename string
-	Mtime    int64
-	SHA256   string
-	Deb822   string
-
-	Size     int64
-	DataSize int64
+	Package      string
+	Version      string
+	Architecture string
+	Filename     string
+	Mtime        int64
+	SHA256       string
+	Deb822       string
+
+	Size        int64
+	DataSize    int64
+	Compression string // of data.tar
 
 	Provides []string
 	Depends  []string
 	Contents []*FileInfo
+	ELFs     []*ELFSOInfo
+	PEs      []*PESOInfo
+	Archives []*StaticLibrary
+
+	PEProvides []string
+	PEDepends  []string
+
+	VersionProvides []ELFVersion
+	VersionDepends  []ELFVersion
+	VersionMinimum  []ELFVersion
+
+	Hardening HardeningSummary
 }
 
+// HardeningSummary counts the objects of a package having each property.
+// PIE is counted over executables only.
+type HardeningSummary struct {
+	Objects        int
+	Executables    int
+	PIE            int
+	RELRO          int
+	BindNow        int
+	NXStack        int
+	StackProtector int
+	Fortify        int
+	IBT            int
+	SHSTK          int
+}
+
+// Stages of the scan a package can fail in, as recorded in scan_failures.
+const (
+	StageControl = "control"
+	StageData    = "data"
+)
+
+var ErrNoControlFile = errors.New("control.tar has no ./control")
+
 var NumCPU = runtime.NumCPU()
 var goroutinePool = make(chan int, NumCPU)
 
@@ -56,6 +97,7 @@ var packagesTotal int64
 var packagesCurrent int64
 var filesCurrent int64
 var elfsCurrent int64
+var staticCurrent int64
 
 var Packages []*PackageInfo
 
@@ -73,7 +115,7 @@ func scan() {
 		if info.IsDir() {
 			return nil
 		}
-		if strings.HasSuffix(info.Name(), ".deb") {
+		if strings.HasSuffix(info.Name(), ".deb") || strings.HasSuffix(info.Name(), ".ddeb") {
 			info := GetPackageInfo(path)
 			if info == nil {
 				return nil
@@ -102,11 +144,12 @@ func scan() {
 			fmt.Print("\u001b[A\u001b[A\u001b[A")
 			progressBar(60, "Hash      ", prevHash, hashCurrent, hashTotalSize, Duration)
 			progressBar(60, "Decompress", prevDec, decompressCurrent, decompressTotalSize, Duration)
-			fmt.Printf("\u001b[0G\u001b[2KPackages: %d / %d\tFiles: %d\tELF: %d\n",
+			fmt.Printf("\u001b[0G\u001b[2KPackages: %d / %d\tFiles: %d\tELF: %d\tStatic: %d\n",
 				packagesCurrent,
 				packagesTotal,
 				filesCurrent,
 				elfsCurrent,
+				staticCurrent,
 			)
 		}
 	}()
@@ -140,35 +183,76 @@ func DoPackage(info *PackageInfo) {
 
 	JobChecksum(info)
 
-	f, _ := os.Open(info.Filename)
+	f, err := os.Open(info.Filename)
+	if err != nil {
+		JobFailure(info.Filename, info.Mtime, info, StageData, err)
+		return
+	}
 	defer f.Close()
 
-	var arInfo, arReader = ArFind(f, "data.tar.")
+	arInfo, arReader, err := DebFind(f, debDataMember)
+	if err != nil {
+		JobFailure(info.Filename, info.Mtime, info, StageData, err)
+		return
+	}
 	var dataFileReader = NewMeter(arReader, &decompressCurrent)
 
-	dataReader := Decompress(arInfo.Name, dataFileReader)
+	dataReader, compression, err := Decompress(arInfo.Name, arInfo.Size, dataFileReader)
+	if err != nil {
+		JobFailure(info.Filename, info.Mtime, info, StageData, err)
+		return
+	}
 	defer dataReader.Close()
+	info.Compression = compression
 
 	// Use map to ignore duplication fast
 	var soname = make(map[string]bool, 20)
-	var needed = make(map[string]bool, 100)
 
+	if err := JobDataUpdate(info, soname, dataReader); err != nil {
+		JobFailure(info.Filename, info.Mtime, info, StageData, err)
+		return
+	}
+	JobELFDependencyFinal(info, soname)
+	JobPEDependencyFinal(info)
+	JobHardeningFinal(info)
+
+	if err := dbInsert(info); err != nil {
+		log.Fatalln(info.Package, err)
+	}
+}
+
+// JobDataUpdate scans the files of the data member. It reads the member
+// past the end-of-archive marker of tar up to the end of the stream, where
+// the decompressors check the integrity of what they have decoded.
+func JobDataUpdate(info *PackageInfo, soname map[string]bool, dataReader io.Reader) error {
 	var tarReader = tar.NewReader(dataReader)
 	for {
 		header, err := tarReader.Next()
 		if err == io.EOF {
 			break
 		} else if err != nil {
-			log.Print(info.Package, " ", err, "\n\n\n\n")
-			return
+			return err
 		}
 		JobContentsUpdate(info, header)
-		JobELFDependencyUpdate(soname, needed, header.Name, tarReader)
+		switch {
+		case IsPEFile(header.Name):
+			JobPEDependencyUpdate(info, header.Name, tarReader)
+		case IsStaticLibrary(header.Name):
+			JobStaticLibraryUpdate(info, header.Name, tarReader)
+		default:
+			JobELFDependencyUpdate(info, soname, header.Name, header.Size, tarReader)
+		}
 	}
-	JobELFDependencyFinal(info, soname, needed)
+	_, err := io.Copy(ioutil.Discard, dataReader)
+	return err
+}
 
-	if err := dbInsert(info); err != nil {
-		log.Fatalln(info.Package, err)
+// JobFailure logs and records why a package could not be scanned, so that
+// one broken file does not abort the scan of the whole repository.
+func JobFailure(filename string, mtime int64, info *PackageInfo, stage string, failure error) {
+	log.Print(filename, " ", failure, "\n\n\n\n")
+	if err := dbInsertFailure(filename, mtime, info, stage, failure); err != nil {
+		log.Fatalln(filename, err)
 	}
 }
 
@@ -187,37 +271,195 @@ func JobContentsUpdate(info *PackageInfo, header *tar.Header) {
 	atomic.AddInt64(&filesCurrent, 1)
 }
 
-func JobELFDependencyUpdate(soname, needed map[string]bool, file string, reader io.Reader) {
-	var soInfo ELFSOInfo
-	err := analyseELF(reader, &soInfo)
+func JobELFDependencyUpdate(info *PackageInfo, soname map[string]bool, file string, size int64, reader io.Reader) {
+	var soInfo = ELFSOInfo{Path: file}
+	if IsKernelModule(file) && !strings.HasSuffix(file, ".ko") {
+		size = -1 // decompressed size is not known
+		moduleReader, _, err := Decompress(file, -1, reader)
+		if err != nil {
+			return
+		}
+		defer func() {
+			// the decompressor has to be done with the tar entry before
+			// the next one is read
+			io.Copy(ioutil.Discard, moduleReader)
+			moduleReader.Close()
+		}()
+		reader = moduleReader
+	}
+	err := analyseELF(reader, size, &soInfo)
 	if err == nil {
-		if soInfo.SoName != "" && InRPath(file) {
+		info.ELFs = append(info.ELFs, &soInfo)
+		if soInfo.Provides = soInfo.SoName != "" && InRPath(file); soInfo.Provides {
 			soname[soInfo.SoName] = true
 		}
-		for _, soDep := range soInfo.Needed {
-			needed[soDep] = true
-		}
 		atomic.AddInt64(&elfsCurrent, 1)
+		if soInfo.Static {
+			atomic.AddInt64(&staticCurrent, 1)
+		}
 	}
 }
 
-func JobELFDependencyFinal(info *PackageInfo, soname, needed map[string]bool) {
+// JobELFDependencyFinal resolves the NEEDED entries of every object against
+// the package itself, then derives the package level provides and depends
+// from the per-object results.
+func JobELFDependencyFinal(info *PackageInfo, soname map[string]bool) {
 	// Collect so file names
 	for provides := range soname {
 		info.Provides = append(info.Provides, provides)
 	}
-	// Collect so file dependencies (remove self-resolved dependencies)
-DEPENDS:
-	for depends := range needed {
-		if _, exist := soname[depends]; exist { // short path
-			continue DEPENDS
+	// Collect NEEDED entries of each object, skipping those resolved through
+	// RPATH/RUNPATH and those provided by the package itself
+	var files = make(map[string]bool, len(info.Contents))
+	for _, file := range info.Contents {
+		files[path.Join("/", file.Path, file.Name)] = true
+	}
+	var depends = make(map[string]bool, 100)
+	for _, soInfo := range info.ELFs {
+		for _, soDep := range soInfo.Needed {
+			if !ResolvedInPackage(soInfo, soDep, files, soname) {
+				soInfo.Depends = append(soInfo.Depends, soDep)
+				depends[soDep] = true
+			}
+		}
+	}
+	for soDep := range depends {
+		info.Depends = append(info.Depends, soDep)
+	}
+	// Collect symbol versions of provided libraries and of dependencies
+	var verProvides = make(map[ELFVersion]bool)
+	var verDepends = make(map[ELFVersion]bool)
+	for _, soInfo := range info.ELFs {
+		if soInfo.Provides {
+			for _, version := range soInfo.VersionDefined {
+				verProvides[ELFVersion{SoName: soInfo.SoName, Version: version}] = true
+			}
+		}
+		for _, version := range soInfo.VersionNeeded {
+			if depends[version.SoName] {
+				verDepends[version] = true
+			}
+		}
+	}
+	for version := range verProvides {
+		info.VersionProvides = append(info.VersionProvides, version)
+	}
+	for version := range verDepends {
+		info.VersionDepends = append(info.VersionDepends, version)
+	}
+	info.VersionMinimum = MinimumVersions(info.VersionDepends)
+}
+
+func JobPEDependencyUpdate(info *PackageInfo, file string, reader io.Reader) {
+	var peInfo = PESOInfo{Path: file}
+	if err := analysePE(reader, &peInfo); err == nil {
+		info.PEs = append(info.PEs, &peInfo)
+	}
+}
+
+func JobStaticLibraryUpdate(info *PackageInfo, file string, reader io.Reader) {
+	var archive = StaticLibrary{Path: file}
+	if err := analyseStaticLibrary(reader, &archive); err == nil {
+		info.Archives = append(info.Archives, &archive)
+	}
+}
+
+// JobPEDependencyFinal is JobELFDependencyFinal for PE files. The Windows
+// loader looks DLLs up by their file names, case insensitively, so every
+// DLL of the package is provided under its lower case file name.
+func JobPEDependencyFinal(info *PackageInfo) {
+	var provides = make(map[string]bool)
+	for _, peInfo := range info.PEs {
+		if peInfo.DLL {
+			provides[strings.ToLower(path.Base(peInfo.Path))] = true
 		}
-		for provides := range soname {
-			if MeetSoName(provides, depends) {
-				continue DEPENDS
+	}
+	var depends = make(map[string]bool)
+	for _, peInfo := range info.PEs {
+		for _, dll := range peInfo.Imports {
+			if !provides[dll] {
+				peInfo.Depends = append(peInfo.Depends, dll)
+				depends[dll] = true
 			}
 		}
-		info.Depends = append(info.Depends, depends)
+	}
+	for dll := range provides {
+		info.PEProvides = append(info.PEProvides, dll)
+	}
+	for dll := range depends {
+		info.PEDepends = append(info.PEDepends, dll)
+	}
+}
+
+// ResolvedInPackage reports whether the NEEDED entry soDep of soInfo is
+// satisfied by the package, either by a file in its RPATH/RUNPATH or by a
+// SONAME the package provides.
+func ResolvedInPackage(soInfo *ELFSOInfo, soDep string, files, soname map[string]bool) bool {
+	for _, dir := range soInfo.SearchPath() {
+		if files[path.Join(dir, soDep)] {
+			return true
+		}
+	}
+	if soname[soDep] { // short path
+		return true
+	}
+	for provides := range soname {
+		if MeetSoName(provides, soDep) {
+			return true
+		}
+	}
+	return false
+}
+
+// MinimumVersions keeps the highest required version of each version family
+// (GLIBC, GLIBCXX, CXXABI, ...) per SONAME, which is the minimum version of
+// that library the package can run with.
+func MinimumVersions(versions []ELFVersion) (minimum []ELFVersion) {
+	var highest = make(map[ELFVersion]string)
+	for _, version := range versions {
+		family, number := SplitSymVer(version.Version)
+		key := ELFVersion{SoName: version.SoName, Version: family}
+		if prev, exist := highest[key]; !exist || CompareSymVer(prev, number) < 0 {
+			highest[key] = number
+		}
+	}
+	for key, number := range highest {
+		version := key.Version
+		if number != "" {
+			version += "_" + number
+		}
+		minimum = append(minimum, ELFVersion{SoName: key.SoName, Version: version})
+	}
+	return
+}
+
+func JobHardeningFinal(info *PackageInfo) {
+	var count = func(counter *int, property bool) {
+		if property {
+			*counter++
+		}
+	}
+	var summary = &info.Hardening
+	for _, soInfo := range info.ELFs {
+		if soInfo.Type != int(elf.ET_EXEC) && soInfo.Type != int(elf.ET_DYN) {
+			continue
+		}
+		if soInfo.DebugOnly { // separate debug file, the object it belongs to is counted
+			continue
+		}
+		var h = &soInfo.Hardening
+		summary.Objects++
+		if soInfo.IsExecutable() {
+			summary.Executables++
+			count(&summary.PIE, h.PIE)
+		}
+		count(&summary.RELRO, h.RELRO)
+		count(&summary.BindNow, h.BindNow)
+		count(&summary.NXStack, h.NXStack)
+		count(&summary.StackProtector, h.StackProtector)
+		count(&summary.Fortify, h.Fortify)
+		count(&summary.IBT, h.IBT)
+		count(&summary.SHSTK, h.SHSTK)
 	}
 }
 
@@ -251,16 +493,33 @@ func GetPackageInfo(deb string) *PackageInfo {
 		return nil
 	}
 	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		log.Println(deb, err)
+		return nil
+	}
 
-	arInfo, arReader := ArFind(f, "control.tar.")
-	if arReader == nil {
-		log.Print(deb, " deb corrupted\n\n\n\n")
+	arInfo, arReader, err := DebFind(f, debControlMember)
+	if err != nil {
+		JobFailure(deb, st.ModTime().Unix(), nil, StageControl, err)
+		return nil
+	}
+	dataReader, _, err := Decompress(arInfo.Name, arInfo.Size, arReader)
+	if err != nil {
+		JobFailure(deb, st.ModTime().Unix(), nil, StageControl, err)
 		return nil
 	}
-	dataReader := Decompress(arInfo.Name, arReader)
 	defer dataReader.Close()
 	_, tarReader := TarFind(dataReader, "./control")
-	out, _ := ioutil.ReadAll(tarReader)
+	if tarReader == nil {
+		JobFailure(deb, st.ModTime().Unix(), nil, StageControl, ErrNoControlFile)
+		return nil
+	}
+	out, err := ioutil.ReadAll(tarReader)
+	if err != nil {
+		JobFailure(deb, st.ModTime().Unix(), nil, StageControl, err)
+		return nil
+	}
 	control := string(out)
 	var dict [][]string
 	result := fieldRegex.FindAllStringSubmatch(control, 20)
@@ -268,43 +527,120 @@ func GetPackageInfo(deb string) *PackageInfo {
 		dict = append(dict, field[1:])
 	}
 
-	st, _ := f.Stat()
-	size := st.Size()
-	dataInfo, _ := ArFind(f, "data.tar.")
+	pkg, err := Deb822Find(dict, "Package")
+	if err != nil {
+		JobFailure(deb, st.ModTime().Unix(), nil, StageControl, err)
+		return nil
+	}
+	version, err := Deb822Find(dict, "Version")
+	if err != nil {
+		JobFailure(deb, st.ModTime().Unix(), nil, StageControl, err)
+		return nil
+	}
 	pi := &PackageInfo{
-		Package:  Deb822Find(dict, "Package"),
-		Version:  Deb822Find(dict, "Version"),
-		Filename: deb,
-		Mtime:    st.ModTime().Unix(),
-		Deb822:   control,
-		Size:     size,
-		DataSize: dataInfo.Size,
+		Package:      pkg,
+		Version:      version,
+		Architecture: Deb822Lookup(dict, "Architecture"),
+		Filename:     deb,
+		Mtime:        st.ModTime().Unix(),
+		Deb822:       control,
+		Size:         st.Size(),
 	}
+	dataInfo, _, err := DebFind(f, debDataMember)
+	if err != nil {
+		JobFailure(deb, pi.Mtime, pi, StageControl, err)
+		return nil
+	}
+	pi.DataSize = dataInfo.Size
 	return pi
 }
 
-func Deb822Find(dict [][]string, key string) string {
+// Deb822Find returns the value of a mandatory field, or an error if the
+// control file lacks it.
+func Deb822Find(dict [][]string, key string) (string, error) {
+	for _, v := range dict {
+		if v[0] == key {
+			return v[1], nil
+		}
+	}
+	return "", fmt.Errorf("control file has no %s field", key)
+}
+
+// Deb822Lookup is Deb822Find for optional fields, returning "" if absent.
+func Deb822Lookup(dict [][]string, key string) string {
 	for _, v := range dict {
 		if v[0] == key {
 			return v[1]
 		}
 	}
-	panic(key)
+	return ""
 }
 
 func MeetSoName(have, want string) bool {
 	return strings.HasPrefix(have+".", want+".")
 }
 
+// SplitSymVer splits a version node such as GLIBC_2.34 into its family GLIBC
+// and its number 2.34. Nodes without a number (GLIBC_PRIVATE) are a family.
+func SplitSymVer(symver string) (family, number string) {
+	a := strings.LastIndex(symver, "_")
+	if a == -1 || a+1 == len(symver) || symver[a+1] < '0' || symver[a+1] > '9' {
+		return symver, ""
+	}
+	return symver[:a], symver[a+1:]
+}
+
+// CompareSymVer compares two dotted version numbers numerically.
+func CompareSymVer(a, b string) int {
+	var as, bs = strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i != len(as) && i != len(bs); i++ {
+		x, errX := strconv.Atoi(as[i])
+		y, errY := strconv.Atoi(bs[i])
+		if errX != nil || errY != nil {
+			if c := strings.Compare(as[i], bs[i]); c != 0 {
+				return c
+			}
+			continue
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case len(as) < len(bs):
+		return -1
+	case len(as) > len(bs):
+		return 1
+	}
+	return 0
+}
+
+var multiarchRegex = regexp.MustCompile(`^[a-z0-9_]+(-linux|-kfreebsd)?-(gnu|musl)[a-z0-9_]*$`)
+
+// InRPath reports whether file lies directly in one of the default library
+// directories, including the multiarch ones. Libraries in subdirectories are
+// private and are only reachable through RPATH/RUNPATH, which
+// ResolvedInPackage follows.
 func InRPath(file string) bool {
-	var prefixes = []string{
-		"./lib/",
-		"./lib64/",
-		"./usr/lib/",
-		"./usr/lib64/",
-	}
-	for _, prefix := range prefixes {
-		if strings.HasPrefix(file, prefix) {
+	var dirs = []string{
+		"/lib",
+		"/lib32",
+		"/lib64",
+		"/libx32",
+		"/usr/lib",
+		"/usr/lib32",
+		"/usr/lib64",
+		"/usr/libx32",
+	}
+	var dir = path.Dir(path.Join("/", file))
+	for _, libDir := range dirs {
+		if dir == libDir {
+			return true
+		}
+		if path.Dir(dir) == libDir && multiarchRegex.MatchString(path.Base(dir)) {
 			return true
 		}
 	}
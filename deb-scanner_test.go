@@ -0,0 +1,81 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"math/rand"
+	"os/exec"
+	"testing"
+)
+
+// TestJobDataUpdateCorrupt checks that a data member whose compressed
+// stream is damaged after the end of the tar archive fails the scan, with
+// every way Decompress may decode it.
+func TestJobDataUpdateCorrupt(t *testing.T) {
+	var archive bytes.Buffer
+	var tw = tar.NewWriter(&archive)
+	var contents = make([]byte, 512*1024)
+	var random = rand.New(rand.NewSource(1))
+	for i := range contents {
+		contents[i] = "abcdefgh"[random.Intn(8)]
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: "./usr/share/doc/test/contents", Mode: 0644, Size: int64(len(contents)), Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Write(contents)
+	tw.Close()
+
+	var streams = make(map[string][]byte)
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write(archive.Bytes())
+	gw.Close()
+	streams["data.tar.gz"] = gz.Bytes()
+	if _, err := exec.LookPath("xz"); err == nil {
+		cmd := exec.Command("xz", "-T2", "--block-size=65536", "-c")
+		cmd.Stdin = bytes.NewReader(archive.Bytes())
+		xz, err := cmd.Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		streams["data.tar.xz"] = xz
+	}
+
+	var savedReadAhead, savedParallel = ReadAheadSize, ParallelSize
+	defer func() { ReadAheadSize, ParallelSize = savedReadAhead, savedParallel }()
+	for _, mode := range []struct {
+		name                    string
+		readAhead, parallelSize int64
+	}{
+		{"serial", 0, 0},
+		{"read-ahead", 1, 0},
+		{"parallel", 0, 1},
+	} {
+		ReadAheadSize, ParallelSize = mode.readAhead, mode.parallelSize
+		for name, stream := range streams {
+			// The trailer: CRC32 and size of gzip, index and footer of xz
+			var flipped = append([]byte(nil), stream...)
+			flipped[len(flipped)-13] ^= 0x01
+			for damage, data := range map[string][]byte{
+				"intact":    stream,
+				"flipped":   flipped,
+				"truncated": stream[:len(stream)-4],
+			} {
+				reader, _, err := Decompress(name, int64(len(data)), bytes.NewReader(data))
+				if err != nil {
+					t.Fatal(mode.name, name, damage, err)
+				}
+				var info = &PackageInfo{}
+				err = JobDataUpdate(info, make(map[string]bool), reader)
+				reader.Close()
+				if damage == "intact" && (err != nil || len(info.Contents) != 1) {
+					t.Errorf("%s %s intact: %v, %d files", mode.name, name, err, len(info.Contents))
+				}
+				if damage != "intact" && err == nil {
+					t.Errorf("%s %s %s: no error", mode.name, name, damage)
+				}
+			}
+		}
+	}
+}
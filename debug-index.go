@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+const FindingNoDebugSymbols = "missing-debug-symbols"
+
+// checkDebugSymbols matches the build-id of every ELF object with the files
+// of -dbgsym packages, which are named after it as
+// /usr/lib/debug/.build-id/xx/yyyy.debug, and stores the result in
+// debug_index. Objects with a build-id but no debug file are reported.
+func checkDebugSymbols() error {
+	buildIDs, err := dbBuildIDs()
+	if err != nil {
+		return err
+	}
+	files, err := dbDebugFiles()
+	if err != nil {
+		return err
+	}
+	var debugFiles = make(map[string]ELFObjectKey, len(files))
+	for _, file := range files {
+		if buildID := BuildIDFromDebugPath(file.Path); buildID != "" {
+			debugFiles[buildID] = file
+		}
+	}
+
+	var findings []Finding
+	for key, buildID := range buildIDs {
+		if _, exist := debugFiles[buildID]; !exist {
+			findings = append(findings, Finding{
+				ELFObjectKey: key,
+				Kind:         FindingNoDebugSymbols,
+				Subject:      buildID,
+			})
+		}
+	}
+	if err := dbReplaceDebugIndex(buildIDs, debugFiles); err != nil {
+		return err
+	}
+
+	fmt.Printf("Debug symbols: %d build-ids, %d debug files, %d findings\n", len(buildIDs), len(debugFiles), len(findings))
+	return dbReplaceFindings([]string{FindingNoDebugSymbols}, findings)
+}
+
+// BuildIDFromDebugPath returns the build-id a debug file is named after, or
+// "" if the path does not follow the .build-id/xx/yyyy.debug layout.
+func BuildIDFromDebugPath(file string) string {
+	dir, name := path.Split(file)
+	dir = path.Clean(dir)
+	if !strings.HasSuffix(name, ".debug") || path.Base(path.Dir(dir)) != ".build-id" {
+		return ""
+	}
+	return path.Base(dir) + strings.TrimSuffix(name, ".debug")
+}
@@ -1,163 +1,1037 @@
 package main
 
-/*
-#include <stdlib.h>
-#include <string.h>
-#include <elf.h>
-
-void copy_elf_hdr(Elf64_Ehdr *ehdr, void *raw) {
-    memcpy(ehdr, raw, sizeof(Elf64_Ehdr));
-    free(raw);
-}
-
-void copy_sec_hdr(Elf64_Shdr *shdr, void *raw) {
-    memcpy(shdr, raw, sizeof(Elf64_Shdr));
-    free(raw);
-}
-
-void copy_dyntab_entry(Elf64_Dyn *dyntab, void *raw) {
-    memcpy(dyntab, raw, sizeof(Elf64_Dyn));
-    free(raw);
-}
-*/
-import "C"
-
 import (
 	"bytes"
+	"debug/elf"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"io"
-	"unsafe"
+	"io/ioutil"
+	"math"
+	"path"
+	"strings"
 )
 
 type ELFSOInfo struct {
-	Type   int
-	SoName string
-	Needed []string
+	Path    string
+	Class   int
+	Data    int
+	Type    int
+	Machine int
+	SoName  string
+	Needed  []string
+	RPath   []string
+	RunPath []string
+
+	Interpreter string
+	Libc        string
+	BuildID     string
+
+	Hardening ELFHardening
+
+	TextRel   bool     // DT_TEXTREL or DF_TEXTREL
+	DebugInfo bool     // has .debug_* or .zdebug_* sections
+	SymTab    bool     // has .symtab, i.e. not stripped
+	DynSym    bool     // has .dynsym, so Symbols lists all imports and exports
+	DebugOnly bool     // separate debug file, see IsSeparateDebugFile
+	Comment   []string // .comment entries, such as "GCC: (Debian 12.2.0-14) 12.2.0"
+
+	Static    bool     // executable without PT_INTERP and DT_NEEDED
+	Toolchain []string // languages told by their markers, such as "go" or "rust"
+
+	GoVersion string
+	GoModules []GoModule
+
+	RustCrates []RustCrate
+
+	ModInfo []ModInfo // .modinfo of kernel modules
+
+	VersionNeeded  []ELFVersion
+	VersionDefined []string
+
+	Symbols []ELFSymbol
+
+	// Filled in by JobELFDependencyFinal, which sees the whole package.
+	Provides bool     // SONAME installed in a default library directory
+	Depends  []string // NEEDED entries the package does not resolve itself
+}
+
+// ELFSymbol is a global or weak dynamic symbol, either defined (exported)
+// or undefined (imported) by an object.
+type ELFSymbol struct {
+	Name    string
+	Defined bool
+	Weak    bool
+}
+
+// ELFHardening holds the properties checked by checksec and alike.
+type ELFHardening struct {
+	PIE            bool // position independent executable
+	RELRO          bool // PT_GNU_RELRO, full RELRO together with BindNow
+	BindNow        bool // DF_BIND_NOW, DF_1_NOW or DT_BIND_NOW
+	NXStack        bool // PT_GNU_STACK without PF_X
+	StackProtector bool // imports __stack_chk_fail
+	Fortify        bool // imports __*_chk functions
+	IBT            bool // GNU_PROPERTY_X86_FEATURE_1_IBT
+	SHSTK          bool // GNU_PROPERTY_X86_FEATURE_1_SHSTK
+}
+
+// ELFVersion is a symbol version node, such as GLIBC_2.34 of libc.so.6.
+type ELFVersion struct {
+	SoName  string
+	Version string
 }
 
 var (
-	ErrNotAnELF            = errors.New("not an ELF file")
-	ErrNotSupportedELFArch = errors.New("ELF architecture is not supported")
+	ErrNotAnELF             = errors.New("not an ELF file")
+	ErrNotSupportedELFArch  = errors.New("ELF architecture is not supported")
+	ErrNotSupportedELFClass = errors.New("ELF class is not supported")
+	ErrNotSupportedELFData  = errors.New("ELF data encoding is not supported")
+)
+
+// Machine types of the architectures shipped by Debian and its ports.
+var supportedELFMachines = map[uint16]bool{
+	uint16(elf.EM_X86_64):    true, // amd64, x32
+	uint16(elf.EM_AARCH64):   true, // arm64
+	uint16(elf.EM_PPC64):     true, // ppc64el, ppc64
+	uint16(elf.EM_S390):      true, // s390x
+	uint16(elf.EM_RISCV):     true, // riscv64
+	uint16(elf.EM_LOONGARCH): true, // loong64
+	uint16(elf.EM_MIPS):      true, // mipsel, mips64el
+	uint16(elf.EM_ALPHA):     true, // alpha
+	uint16(elf.EM_IA_64):     true, // ia64
+	uint16(elf.EM_SPARCV9):   true, // sparc64
+	uint16(elf.EM_386):       true, // i386, hurd-i386, kfreebsd-i386
+	uint16(elf.EM_ARM):       true, // armel, armhf
+	uint16(elf.EM_PPC):       true, // powerpc
+	uint16(elf.EM_PARISC):    true, // hppa
+	uint16(elf.EM_68K):       true, // m68k
+	uint16(elf.EM_SH):        true, // sh4
+}
+
+// Sizes of the ELF structures we decode, see elf(5).
+const (
+	elf32EhdrSize = 52
+	elf64EhdrSize = 64
+	elf32PhdrSize = 32
+	elf64PhdrSize = 56
+	elf32ShdrSize = 40
+	elf64ShdrSize = 64
+	elf32DynSize  = 8
+	elf64DynSize  = 16
+	elf32SymSize  = 16
+	elf64SymSize  = 24
+
+	// Elfxx_Verneed, Elfxx_Vernaux, Elfxx_Verdef and Elfxx_Verdaux
+	// have the same layout in both classes.
+	verneedSize = 16
+	vernauxSize = 16
+	verdefSize  = 20
+	verdauxSize = 8
+
+	verFlagBase = 0x1 // VER_FLG_BASE
+
+	stbGNUUnique = elf.STB_LOOS // STB_GNU_UNIQUE
+
+	ntGNUBuildID       = 3          // NT_GNU_BUILD_ID
+	ntGNUPropertyType0 = 5          // NT_GNU_PROPERTY_TYPE_0
+	gnuPropertyX86And  = 0xc0000002 // GNU_PROPERTY_X86_FEATURE_1_AND
+	gnuPropertyX86IBT  = 0x1        // GNU_PROPERTY_X86_FEATURE_1_IBT
+	gnuPropertyX86SHSK = 0x2        // GNU_PROPERTY_X86_FEATURE_1_SHSTK
+
+	ntGoBuildID = 4 // NT_GO_BUILDID, written by cmd/link
 )
 
-func analyseELF(input io.Reader, info *ELFSOInfo) error {
-	var buffer = NewUDFR(input)
+// Class independent views of the ELF structures we are interested in.
+type elfHeader struct {
+	Class    byte
+	Order    binary.ByteOrder
+	Type     uint16
+	Machine  uint16
+	PhOff    uint64
+	PhNum    uint16
+	ShOff    uint64
+	ShNum    uint16
+	ShStrNdx uint16
+}
+
+type elfSegment struct {
+	Type     uint32
+	Flags    uint32
+	Offset   uint64
+	VAddr    uint64
+	FileSize uint64
+}
+
+type elfSection struct {
+	Name   uint32
+	Type   uint32
+	Flags  uint64
+	Link   uint32
+	Info   uint32
+	Offset uint64
+	Size   uint64
+}
+
+type elfDyn struct {
+	Tag int64
+	Val uint64
+}
+
+// analyseELF reads an ELF object of size bytes, or of unknown size if size
+// is negative.
+func analyseELF(input io.Reader, size int64, info *ELFSOInfo) error {
+	if err := readELF(NewSizedUDFR(input, size), info, false); err != nil {
+		return err
+	}
+	AuditHardening(info)
+	DetectStatic(info)
+	return nil
+}
+
+// analyseArchiveMember is analyseELF for the objects of a static library,
+// whose defined symbols are read from the static symbol table.
+func analyseArchiveMember(input io.Reader, size int64, info *ELFSOInfo) error {
+	return readELF(NewSizedUDFR(input, size), info, true)
+}
+
+// readELF reads the ELF object. The defined symbols of an ET_REL object are
+// read from .symtab only for archive members; those of loose objects and
+// kernel modules in a package are internals, not exports.
+func readELF(buffer *UDFR, info *ELFSOInfo, archiveMember bool) error {
 	var buf []byte
 
 	// Read ELF header
-	var ehdr C.Elf64_Ehdr
+	var ehdr elfHeader
 	{
-		buf = make([]byte, C.sizeof_Elf64_Ehdr)
+		buf = make([]byte, elf.EI_NIDENT, elf64EhdrSize)
 		n, _ := buffer.Read(buf)
 		if n != len(buf) {
 			return ErrNotAnELF
 		}
-		C.copy_elf_hdr(&ehdr, C.CBytes(buf))
+		if err := VerifyELFIdent(buf); err != nil {
+			return err
+		}
+		buf = buf[:ehdrSize(buf[elf.EI_CLASS])]
+		n, _ = buffer.Read(buf[elf.EI_NIDENT:])
+		if n != len(buf)-elf.EI_NIDENT {
+			return ErrNotAnELF
+		}
+		ehdr = parseELFHeader(buf)
 		if err := VerifyELF(&ehdr); err != nil {
 			return err
 		}
 	}
-	info.Type = int(ehdr.e_type)
+	info.Class = int(ehdr.Class)
+	info.Data = int(buf[elf.EI_DATA])
+	info.Type = int(ehdr.Type)
+	info.Machine = int(ehdr.Machine)
 
-	if info.Type != C.ET_EXEC && info.Type != C.ET_DYN { // not an executable or dynamic object
+	switch elf.Type(info.Type) {
+	case elf.ET_EXEC, elf.ET_DYN:
+	case elf.ET_REL: // only the sections are of interest, kernel modules for example
+	default:
 		return nil
 	}
 
-	if ehdr.e_shnum == 0 { // no section
-		return nil
+	// Read program headers
+	var segments = make([]elfSegment, ehdr.PhNum)
+	{
+		var size = phdrSize(ehdr.Class)
+		buf, err := readRange(buffer, ehdr.PhOff, uint64(size*len(segments)))
+		if err != nil {
+			return err
+		}
+		for i := range segments {
+			segments[i] = parseELFSegment(&ehdr, buf[size*i:])
+		}
+	}
+
+	for i := range segments {
+		switch elf.ProgType(segments[i].Type) {
+		case elf.PT_INTERP:
+			buf, err := readRange(buffer, segments[i].Offset, segments[i].FileSize)
+			if err != nil {
+				return err
+			}
+			info.Interpreter = StringFromTable(buf, 0)
+			info.Libc = LibcFlavour(info.Interpreter)
+		case elf.PT_GNU_RELRO:
+			info.Hardening.RELRO = true
+		case elf.PT_GNU_STACK:
+			info.Hardening.NXStack = elf.ProgFlag(segments[i].Flags)&elf.PF_X == 0
+		}
+	}
+
+	if ehdr.ShNum == 0 { // no section, stripped by sstrip or alike
+		for i := range segments {
+			if elf.ProgType(segments[i].Type) == elf.PT_NOTE {
+				buf, err := readRange(buffer, segments[i].Offset, segments[i].FileSize)
+				if err != nil {
+					return err
+				}
+				ReadNotes(&ehdr, buf, info)
+			}
+		}
+		return readDynamicSegment(buffer, &ehdr, segments, info)
 	}
 
 	// Read section headers
-	var sections = make([]C.Elf64_Shdr, ehdr.e_shnum)
+	var sections = make([]elfSection, ehdr.ShNum)
 	{
-		buffer.Seek(int64(ehdr.e_shoff), io.SeekStart, true)
-		buf = make([]byte, C.sizeof_Elf64_Shdr*int64(ehdr.e_shnum))
-		n, _ := buffer.Read(buf)
-		if n != len(buf) {
-			return ErrNotAnELF
+		var size = shdrSize(ehdr.Class)
+		buf, err := readRange(buffer, ehdr.ShOff, uint64(size*len(sections)))
+		if err != nil {
+			return err
 		}
 		for i := range sections {
-			p := buf[C.sizeof_Elf64_Shdr*i:]
-			C.copy_sec_hdr(&sections[i], C.CBytes(p))
+			sections[i] = parseELFSection(&ehdr, buf[size*i:])
+		}
+	}
+
+	for i := range sections {
+		if elf.SectionType(sections[i].Type) == elf.SHT_NOTE {
+			buf, err := readSection(buffer, &sections[i])
+			if err != nil {
+				return err
+			}
+			ReadNotes(&ehdr, buf, info)
 		}
 	}
 
+	if err := readSectionNames(buffer, &ehdr, segments, sections, info); err != nil {
+		return err
+	}
+
+	if elf.Type(ehdr.Type) == elf.ET_REL { // no dynamic table, the static one tells what it defines
+		if !archiveMember {
+			return nil
+		}
+		for i := range sections {
+			if elf.SectionType(sections[i].Type) == elf.SHT_SYMTAB {
+				symTab, symStrTab, err := readLinkedSection(buffer, sections, i)
+				if err != nil {
+					return err
+				}
+				info.Symbols = DefinedSymbols(ReadSymbols(&ehdr, symTab, symStrTab, false))
+			}
+		}
+		return nil
+	}
+
 	var dynamicSection, strTabSection, err = FindDynamicAndStringTableSection(sections)
 	if err != nil {
 		return errors.New("no string table linked to DYNAMIC")
 	}
 
-	if dynamicSection == nil || dynamicSection.sh_size == 0 { // static linked file
-		return nil
+	if dynamicSection == nil || dynamicSection.Size == 0 { // no DYNAMIC section
+		if IsSeparateDebugFile(sections) { // segments point to stripped data
+			info.DebugOnly = true
+			return nil
+		}
+		return readDynamicSegment(buffer, &ehdr, segments, info)
 	}
 
-	var strTab = make([]byte, strTabSection.sh_size)
-	var dynTab = make([]C.Elf64_Dyn, dynamicSection.sh_size/C.sizeof_Elf64_Dyn)
-	strTabFunc := func() error {
-		buffer.Seek(int64(strTabSection.sh_offset), io.SeekStart, false)
-		if n, _ := buffer.Read(strTab); n != len(strTab) {
-			return ErrNotAnELF
+	strTab, err := readSection(buffer, strTabSection)
+	if err != nil {
+		return err
+	}
+	buf, err = readSection(buffer, dynamicSection)
+	if err != nil {
+		return err
+	}
+	ReadDynamicTable(parseELFDynTab(&ehdr, buf), strTab, info)
+
+	// Read symbol version requirements and definitions
+	for i := range sections {
+		switch elf.SectionType(sections[i].Type) {
+		case elf.SHT_GNU_VERNEED:
+			verTab, verStrTab, err := readLinkedSection(buffer, sections, i)
+			if err != nil {
+				return err
+			}
+			info.VersionNeeded = ReadVersionNeed(&ehdr, verTab, verStrTab, sections[i].Info)
+		case elf.SHT_GNU_VERDEF:
+			verTab, verStrTab, err := readLinkedSection(buffer, sections, i)
+			if err != nil {
+				return err
+			}
+			info.VersionDefined = ReadVersionDef(&ehdr, verTab, verStrTab, sections[i].Info)
+		case elf.SHT_DYNSYM:
+			symTab, symStrTab, err := readLinkedSection(buffer, sections, i)
+			if err != nil {
+				return err
+			}
+			info.Symbols = ReadDynamicSymbols(&ehdr, symTab, symStrTab)
+			info.DynSym = true
 		}
+	}
+
+	return nil
+}
+
+// readSectionNames looks for debugging information, the static symbol table
+// the .comment section, the language markers and the kernel module information
+// by the section names in e_shstrndx.
+func readSectionNames(buffer *UDFR, ehdr *elfHeader, segments []elfSegment, sections []elfSection, info *ELFSOInfo) error {
+	if ehdr.ShStrNdx == uint16(elf.SHN_UNDEF) || int(ehdr.ShStrNdx) >= len(sections) {
 		return nil
 	}
-	dynTabFunc := func() error {
-		buffer.Seek(int64(dynamicSection.sh_offset), io.SeekStart, false)
-		buf = make([]byte, C.sizeof_Elf64_Dyn*int64(dynamicSection.sh_size)/C.sizeof_Elf64_Dyn)
-		n, _ := buffer.Read(buf)
-		if n != len(buf) {
-			return ErrNotAnELF
+	shStrTab, err := readSection(buffer, &sections[ehdr.ShStrNdx])
+	if err != nil {
+		return err
+	}
+	for i := range sections {
+		name := StringFromTable(shStrTab, uint64(sections[i].Name))
+		switch {
+		case strings.HasPrefix(name, ".debug_"), strings.HasPrefix(name, ".zdebug_"):
+			info.DebugInfo = info.DebugInfo || elf.SectionType(sections[i].Type) != elf.SHT_NOBITS
+		case name == ".symtab":
+			info.SymTab = true
+		case name == ".comment":
+			buf, err := readSection(buffer, &sections[i])
+			if err != nil {
+				return err
+			}
+			info.Comment = ReadComment(buf)
+		case name == ".go.buildinfo":
+			info.AddToolchain("go")
+			buf, err := readSection(buffer, &sections[i])
+			if err != nil {
+				return err
+			}
+			// a damaged build info does not make the object unusable
+			ReadGoBuildInfo(buffer, segments, buf, info)
+		case name == ".gopclntab":
+			info.AddToolchain("go")
+		case name == ".dep-v0":
+			info.AddToolchain("rust")
+			buf, err := readSection(buffer, &sections[i])
+			if err != nil {
+				return err
+			}
+			// a damaged crate list does not make the object unusable
+			info.RustCrates, _ = ReadRustAudit(buf)
+		case name == ".rustc":
+			info.AddToolchain("rust")
+		case name == ".modinfo":
+			buf, err := readSection(buffer, &sections[i])
+			if err != nil {
+				return err
+			}
+			info.ModInfo = ReadModInfo(buf)
+		}
+	}
+	for _, entry := range info.Comment {
+		if strings.HasPrefix(entry, "rustc version ") {
+			info.AddToolchain("rust")
 		}
-		for i := range dynTab {
-			C.copy_dyntab_entry(&dynTab[i], C.CBytes(buf[C.sizeof_Elf64_Dyn*i:]))
+	}
+	return nil
+}
+
+// AddToolchain records a language marker once.
+func (info *ELFSOInfo) AddToolchain(toolchain string) {
+	for _, known := range info.Toolchain {
+		if known == toolchain {
+			return
 		}
-		return nil
 	}
+	info.Toolchain = append(info.Toolchain, toolchain)
+}
 
-	if strTabSection.sh_offset < dynamicSection.sh_offset {
-		strTabFunc()
-		dynTabFunc()
-	} else {
-		dynTabFunc()
-		strTabFunc()
+// ReadComment splits the .comment section, where each object linked in
+// appends the identification of its compiler, and drops the duplicates.
+func ReadComment(comment []byte) (Entries []string) {
+	var seen = make(map[string]bool)
+	for _, entry := range strings.Split(string(comment), "\x00") {
+		if entry == "" || seen[entry] {
+			continue
+		}
+		seen[entry] = true
+		Entries = append(Entries, entry)
 	}
+	return
+}
 
-	info.SoName, info.Needed = ReadDynamicTable(dynTab, strTab)
+// LibcFlavour tells the C library an executable is built against from the
+// dynamic linker it requests.
+func LibcFlavour(interpreter string) string {
+	var name = path.Base(interpreter)
+	switch {
+	case strings.HasPrefix(name, "ld-musl-"):
+		return "musl"
+	case strings.HasPrefix(name, "ld-uClibc"):
+		return "uclibc"
+	case strings.HasPrefix(name, "ld-linux"),
+		strings.HasPrefix(name, "ld64.so."),
+		strings.HasPrefix(name, "ld.so."):
+		return "glibc"
+	case name == "ld-elf.so.1":
+		return "freebsd"
+	case name == "linker" || name == "linker64":
+		return "bionic"
+	}
+	return ""
+}
 
+// IsSeparateDebugFile tells a file made by objcopy --only-keep-debug, whose
+// code and data sections were turned into SHT_NOBITS, from a real object.
+func IsSeparateDebugFile(sections []elfSection) bool {
+	for i := range sections {
+		if elf.SectionType(sections[i].Type) == elf.SHT_NOBITS &&
+			elf.SectionFlag(sections[i].Flags)&elf.SHF_EXECINSTR != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadNotes walks a note section or segment for the GNU build-id and the
+// x86 CET feature bits of the GNU property note, and for the Go build ID.
+func ReadNotes(ehdr *elfHeader, notes []byte, info *ELFSOInfo) {
+	var order = ehdr.Order
+	for off := 0; off+12 <= len(notes); {
+		nameSize := int(order.Uint32(notes[off:]))
+		descSize := int(order.Uint32(notes[off+4:]))
+		noteType := order.Uint32(notes[off+8:])
+		name := off + 12
+		desc := name + (nameSize+3)&^3
+		next := desc + (descSize+3)&^3
+		if nameSize < 0 || descSize < 0 || desc+descSize > len(notes) {
+			break
+		}
+		switch string(notes[name : name+nameSize]) {
+		case "GNU\x00":
+			switch noteType {
+			case ntGNUBuildID:
+				info.BuildID = hex.EncodeToString(notes[desc : desc+descSize])
+			case ntGNUPropertyType0:
+				readGNUProperties(ehdr, notes[desc:desc+descSize], info)
+			}
+		case "Go\x00\x00":
+			if noteType == ntGoBuildID {
+				info.AddToolchain("go")
+			}
+		}
+		off = next
+	}
+}
+
+// readGNUProperties reads the CET features of x86 objects from the
+// properties of NT_GNU_PROPERTY_TYPE_0. Processor-specific property types
+// mean other things on other machines.
+func readGNUProperties(ehdr *elfHeader, props []byte, info *ELFSOInfo) {
+	switch elf.Machine(ehdr.Machine) {
+	case elf.EM_X86_64, elf.EM_386:
+	default:
+		return
+	}
+	var order = ehdr.Order
+	var align = 8
+	if elf.Class(ehdr.Class) == elf.ELFCLASS32 {
+		align = 4
+	}
+	for off := 0; off+8 <= len(props); {
+		propType := order.Uint32(props[off:])
+		dataSize := int(order.Uint32(props[off+4:]))
+		data := off + 8
+		if dataSize < 0 || data+dataSize > len(props) {
+			break
+		}
+		if propType == gnuPropertyX86And && dataSize >= 4 {
+			features := order.Uint32(props[data:])
+			info.Hardening.IBT = features&gnuPropertyX86IBT != 0
+			info.Hardening.SHSTK = features&gnuPropertyX86SHSK != 0
+		}
+		off = data + (dataSize+align-1)&^(align-1)
+	}
+}
+
+// AuditHardening completes the hardening properties which derive from the
+// parsed dynamic table and symbols.
+func AuditHardening(info *ELFSOInfo) {
+	switch elf.Type(info.Type) {
+	case elf.ET_DYN:
+		info.Hardening.PIE = info.Hardening.PIE || info.Interpreter != ""
+	case elf.ET_EXEC:
+		info.Hardening.PIE = false
+	default:
+		return
+	}
+	for _, symbol := range info.Symbols {
+		if symbol.Defined {
+			continue
+		}
+		switch {
+		case symbol.Name == "__stack_chk_fail", symbol.Name == "__stack_chk_guard":
+			info.Hardening.StackProtector = true
+		case strings.HasPrefix(symbol.Name, "__") && strings.HasSuffix(symbol.Name, "_chk"):
+			info.Hardening.Fortify = true
+		}
+	}
+}
+
+// DetectStatic marks executables which are linked statically, static-pie
+// included. They embed their libraries and have to be rebuilt whenever one
+// of those is fixed. ld.so has neither PT_INTERP nor DT_NEEDED too, but it
+// does not carry DF_1_PIE.
+func DetectStatic(info *ELFSOInfo) {
+	if info.DebugOnly || info.Interpreter != "" || len(info.Needed) != 0 {
+		return
+	}
+	switch elf.Type(info.Type) {
+	case elf.ET_EXEC:
+		info.Static = true
+	case elf.ET_DYN:
+		info.Static = info.Hardening.PIE
+	}
+}
+
+// IsExecutable tells executables from shared libraries.
+func (info *ELFSOInfo) IsExecutable() bool {
+	return info.Type == int(elf.ET_EXEC) || info.Type == int(elf.ET_DYN) && info.Hardening.PIE
+}
+
+// readDynamicSegment reads the dynamic table through PT_DYNAMIC, for objects
+// whose section headers are missing. DT_STRTAB is an address, which is
+// translated to a file offset through the PT_LOAD segments.
+func readDynamicSegment(buffer *UDFR, ehdr *elfHeader, segments []elfSegment, info *ELFSOInfo) error {
+	var dynamic *elfSegment
+	for i := range segments {
+		if elf.ProgType(segments[i].Type) == elf.PT_DYNAMIC {
+			dynamic = &segments[i]
+			break
+		}
+	}
+	if dynamic == nil || dynamic.FileSize == 0 { // static linked file
+		return nil
+	}
+
+	buf, err := readRange(buffer, dynamic.Offset, dynamic.FileSize)
+	if err != nil {
+		return err
+	}
+	var dynTab = parseELFDynTab(ehdr, buf)
+	var strTabAddr, strTabSize uint64
+	for i := range dynTab {
+		switch elf.DynTag(dynTab[i].Tag) {
+		case elf.DT_STRTAB:
+			strTabAddr = dynTab[i].Val
+		case elf.DT_STRSZ:
+			strTabSize = dynTab[i].Val
+		}
+	}
+	strTabOffset, ok := AddressToOffset(segments, strTabAddr)
+	if !ok {
+		return errors.New("no PT_LOAD maps DT_STRTAB")
+	}
+	strTab, err := readRange(buffer, strTabOffset, strTabSize)
+	if err != nil {
+		return err
+	}
+	ReadDynamicTable(dynTab, strTab, info)
 	return nil
 }
 
-func VerifyELF(ehdr *C.Elf64_Ehdr) error {
-	var Ident = C.GoBytes(unsafe.Pointer(&ehdr.e_ident[0]), 16)
-	if !bytes.HasPrefix(Ident, []byte(C.ELFMAG)) {
+// AddressToOffset translates a virtual address to a file offset.
+func AddressToOffset(segments []elfSegment, addr uint64) (uint64, bool) {
+	for i := range segments {
+		if elf.ProgType(segments[i].Type) != elf.PT_LOAD {
+			continue
+		}
+		if addr >= segments[i].VAddr && addr-segments[i].VAddr < segments[i].FileSize {
+			return segments[i].Offset + addr - segments[i].VAddr, true
+		}
+	}
+	return 0, false
+}
+
+// readRange reads size bytes at offset. The range comes from the file
+// itself, so it is checked against the size of the file before anything is
+// allocated for it. If the size is unknown, the data is read as it comes, so
+// that a bogus range fails at the end of the file instead.
+func readRange(buffer *UDFR, offset, size uint64) ([]byte, error) {
+	if !buffer.Contains(offset, size) || offset > math.MaxInt64 || size > math.MaxInt64 {
+		return nil, ErrNotAnELF
+	}
+	if _, err := buffer.Seek(int64(offset), io.SeekStart); err != nil {
+		return nil, ErrNotAnELF
+	}
+	if buffer.size < 0 {
+		data, _ := ioutil.ReadAll(io.LimitReader(buffer, int64(size)))
+		if uint64(len(data)) != size {
+			return nil, ErrNotAnELF
+		}
+		return data, nil
+	}
+	var data = make([]byte, size)
+	if n, _ := buffer.Read(data); n != len(data) {
+		return nil, ErrNotAnELF
+	}
+	return data, nil
+}
+
+// readSection reads the data of a section. SHT_NOBITS sections, such as
+// .bss or the sections objcopy --only-keep-debug empties, have none in the
+// file.
+func readSection(buffer *UDFR, section *elfSection) ([]byte, error) {
+	if elf.SectionType(section.Type) == elf.SHT_NOBITS {
+		return nil, nil
+	}
+	return readRange(buffer, section.Offset, section.Size)
+}
+
+// readLinkedSection reads a section together with the string table its
+// sh_link refers to.
+func readLinkedSection(buffer *UDFR, sections []elfSection, index int) (data, strTab []byte, err error) {
+	if int(sections[index].Link) >= len(sections) {
+		return nil, nil, ErrNotAnELF
+	}
+	if data, err = readSection(buffer, &sections[index]); err != nil {
+		return
+	}
+	strTab, err = readSection(buffer, &sections[sections[index].Link])
+	return
+}
+
+func VerifyELFIdent(ident []byte) error {
+	if !bytes.HasPrefix(ident, []byte(elf.ELFMAG)) {
 		return ErrNotAnELF
 	}
-	if ehdr.e_machine != C.EM_X86_64 {
+	switch elf.Class(ident[elf.EI_CLASS]) {
+	case elf.ELFCLASS32, elf.ELFCLASS64:
+	default:
+		return ErrNotSupportedELFClass
+	}
+	switch elf.Data(ident[elf.EI_DATA]) {
+	case elf.ELFDATA2LSB, elf.ELFDATA2MSB:
+	default:
+		return ErrNotSupportedELFData
+	}
+	return nil
+}
+
+func VerifyELF(ehdr *elfHeader) error {
+	if !supportedELFMachines[ehdr.Machine] {
 		return ErrNotSupportedELFArch
 	}
 	return nil
 }
 
-func ReadDynamicTable(dynTab []C.Elf64_Dyn, strTab []byte) (SoName string, Needed []string) {
+func ehdrSize(class byte) int {
+	if elf.Class(class) == elf.ELFCLASS32 {
+		return elf32EhdrSize
+	}
+	return elf64EhdrSize
+}
+
+func phdrSize(class byte) int {
+	if elf.Class(class) == elf.ELFCLASS32 {
+		return elf32PhdrSize
+	}
+	return elf64PhdrSize
+}
+
+func shdrSize(class byte) int {
+	if elf.Class(class) == elf.ELFCLASS32 {
+		return elf32ShdrSize
+	}
+	return elf64ShdrSize
+}
+
+func dynSize(class byte) int {
+	if elf.Class(class) == elf.ELFCLASS32 {
+		return elf32DynSize
+	}
+	return elf64DynSize
+}
+
+func parseELFHeader(buf []byte) elfHeader {
+	var order binary.ByteOrder = binary.LittleEndian
+	if elf.Data(buf[elf.EI_DATA]) == elf.ELFDATA2MSB {
+		order = binary.BigEndian
+	}
+	var ehdr = elfHeader{
+		Class:   buf[elf.EI_CLASS],
+		Order:   order,
+		Type:    order.Uint16(buf[16:]),
+		Machine: order.Uint16(buf[18:]),
+	}
+	if elf.Class(ehdr.Class) == elf.ELFCLASS32 {
+		ehdr.PhOff = uint64(order.Uint32(buf[28:]))
+		ehdr.ShOff = uint64(order.Uint32(buf[32:]))
+		ehdr.PhNum = order.Uint16(buf[44:])
+		ehdr.ShNum = order.Uint16(buf[48:])
+		ehdr.ShStrNdx = order.Uint16(buf[50:])
+	} else {
+		ehdr.PhOff = order.Uint64(buf[32:])
+		ehdr.ShOff = order.Uint64(buf[40:])
+		ehdr.PhNum = order.Uint16(buf[56:])
+		ehdr.ShNum = order.Uint16(buf[60:])
+		ehdr.ShStrNdx = order.Uint16(buf[62:])
+	}
+	return ehdr
+}
+
+func parseELFSegment(ehdr *elfHeader, buf []byte) elfSegment {
+	var order = ehdr.Order
+	if elf.Class(ehdr.Class) == elf.ELFCLASS32 {
+		return elfSegment{
+			Type:     order.Uint32(buf[0:]),
+			Flags:    order.Uint32(buf[24:]),
+			Offset:   uint64(order.Uint32(buf[4:])),
+			VAddr:    uint64(order.Uint32(buf[8:])),
+			FileSize: uint64(order.Uint32(buf[16:])),
+		}
+	}
+	return elfSegment{
+		Type:     order.Uint32(buf[0:]),
+		Flags:    order.Uint32(buf[4:]),
+		Offset:   order.Uint64(buf[8:]),
+		VAddr:    order.Uint64(buf[16:]),
+		FileSize: order.Uint64(buf[32:]),
+	}
+}
+
+func parseELFSection(ehdr *elfHeader, buf []byte) elfSection {
+	var order = ehdr.Order
+	if elf.Class(ehdr.Class) == elf.ELFCLASS32 {
+		return elfSection{
+			Name:   order.Uint32(buf[0:]),
+			Type:   order.Uint32(buf[4:]),
+			Flags:  uint64(order.Uint32(buf[8:])),
+			Offset: uint64(order.Uint32(buf[16:])),
+			Size:   uint64(order.Uint32(buf[20:])),
+			Link:   order.Uint32(buf[24:]),
+			Info:   order.Uint32(buf[28:]),
+		}
+	}
+	return elfSection{
+		Name:   order.Uint32(buf[0:]),
+		Type:   order.Uint32(buf[4:]),
+		Flags:  order.Uint64(buf[8:]),
+		Offset: order.Uint64(buf[24:]),
+		Size:   order.Uint64(buf[32:]),
+		Link:   order.Uint32(buf[40:]),
+		Info:   order.Uint32(buf[44:]),
+	}
+}
+
+func parseELFDyn(ehdr *elfHeader, buf []byte) elfDyn {
+	var order = ehdr.Order
+	if elf.Class(ehdr.Class) == elf.ELFCLASS32 {
+		return elfDyn{
+			Tag: int64(int32(order.Uint32(buf[0:]))),
+			Val: uint64(order.Uint32(buf[4:])),
+		}
+	}
+	return elfDyn{
+		Tag: int64(order.Uint64(buf[0:])),
+		Val: order.Uint64(buf[8:]),
+	}
+}
+
+func parseELFDynTab(ehdr *elfHeader, buf []byte) []elfDyn {
+	var size = dynSize(ehdr.Class)
+	var dynTab = make([]elfDyn, len(buf)/size)
 	for i := range dynTab {
-		switch dynTab[i].d_tag {
-		case C.DT_NEEDED:
-			needed := StringFromTable(strTab, a2i(dynTab[i].d_un))
-			Needed = append(Needed, needed)
-		case C.DT_SONAME:
-			soname := StringFromTable(strTab, a2i(dynTab[i].d_un))
-			SoName = soname
+		dynTab[i] = parseELFDyn(ehdr, buf[size*i:])
+	}
+	return dynTab
+}
+
+func ReadDynamicTable(dynTab []elfDyn, strTab []byte, info *ELFSOInfo) {
+	for i := range dynTab {
+		switch elf.DynTag(dynTab[i].Tag) {
+		case elf.DT_NEEDED:
+			needed := StringFromTable(strTab, dynTab[i].Val)
+			info.Needed = append(info.Needed, needed)
+		case elf.DT_SONAME:
+			soname := StringFromTable(strTab, dynTab[i].Val)
+			info.SoName = soname
+		case elf.DT_RPATH:
+			rpath := StringFromTable(strTab, dynTab[i].Val)
+			info.RPath = append(info.RPath, ExpandOrigin(rpath, info.Path)...)
+		case elf.DT_RUNPATH:
+			runpath := StringFromTable(strTab, dynTab[i].Val)
+			info.RunPath = append(info.RunPath, ExpandOrigin(runpath, info.Path)...)
+		case elf.DT_BIND_NOW:
+			info.Hardening.BindNow = true
+		case elf.DT_TEXTREL:
+			info.TextRel = true
+		case elf.DT_FLAGS:
+			if elf.DynFlag(dynTab[i].Val)&elf.DF_BIND_NOW != 0 {
+				info.Hardening.BindNow = true
+			}
+			if elf.DynFlag(dynTab[i].Val)&elf.DF_TEXTREL != 0 {
+				info.TextRel = true
+			}
+		case elf.DT_FLAGS_1:
+			if elf.DynFlag1(dynTab[i].Val)&elf.DF_1_NOW != 0 {
+				info.Hardening.BindNow = true
+			}
+			if elf.DynFlag1(dynTab[i].Val)&elf.DF_1_PIE != 0 {
+				info.Hardening.PIE = true
+			}
+		}
+	}
+}
+
+// ExpandOrigin splits a DT_RPATH/DT_RUNPATH value and substitutes $ORIGIN
+// with the directory of file, which is a path inside data.tar.
+func ExpandOrigin(searchPath string, file string) (dirs []string) {
+	var origin = path.Dir(path.Join("/", file))
+	for _, dir := range strings.Split(searchPath, ":") {
+		if dir == "" {
+			continue
+		}
+		dir = strings.Replace(dir, "${ORIGIN}", origin, -1)
+		dir = strings.Replace(dir, "$ORIGIN", origin, -1)
+		dirs = append(dirs, path.Clean(dir))
+	}
+	return
+}
+
+// SearchPath returns the directories the dynamic linker looks into before
+// the default ones. DT_RPATH is ignored when DT_RUNPATH is present.
+func (info *ELFSOInfo) SearchPath() []string {
+	if len(info.RunPath) != 0 {
+		return info.RunPath
+	}
+	return info.RPath
+}
+
+// ReadVersionNeed walks the Elfxx_Verneed chain of .gnu.version_r.
+func ReadVersionNeed(ehdr *elfHeader, verTab, strTab []byte, count uint32) (Needed []ELFVersion) {
+	var order = ehdr.Order
+	var off uint64
+	for i := uint32(0); i < count; i++ {
+		if off+verneedSize > uint64(len(verTab)) {
+			break
+		}
+		cnt := order.Uint16(verTab[off+2:])
+		file := StringFromTable(strTab, uint64(order.Uint32(verTab[off+4:])))
+		aux := off + uint64(order.Uint32(verTab[off+8:]))
+		for j := uint16(0); j < cnt; j++ {
+			if aux+vernauxSize > uint64(len(verTab)) {
+				break
+			}
+			name := StringFromTable(strTab, uint64(order.Uint32(verTab[aux+8:])))
+			Needed = append(Needed, ELFVersion{SoName: file, Version: name})
+			next := order.Uint32(verTab[aux+12:])
+			if next == 0 {
+				break
+			}
+			aux += uint64(next)
+		}
+		next := order.Uint32(verTab[off+12:])
+		if next == 0 {
+			break
+		}
+		off += uint64(next)
+	}
+	return
+}
+
+// ReadVersionDef walks the Elfxx_Verdef chain of .gnu.version_d. The base
+// definition, which names the object itself, is skipped.
+func ReadVersionDef(ehdr *elfHeader, verTab, strTab []byte, count uint32) (Defined []string) {
+	var order = ehdr.Order
+	var off uint64
+	for i := uint32(0); i < count; i++ {
+		if off+verdefSize > uint64(len(verTab)) {
+			break
 		}
+		flags := order.Uint16(verTab[off+2:])
+		aux := off + uint64(order.Uint32(verTab[off+12:]))
+		if flags&verFlagBase == 0 && aux+verdauxSize <= uint64(len(verTab)) {
+			name := StringFromTable(strTab, uint64(order.Uint32(verTab[aux:])))
+			Defined = append(Defined, name)
+		}
+		next := order.Uint32(verTab[off+16:])
+		if next == 0 {
+			break
+		}
+		off += uint64(next)
 	}
 	return
 }
 
-func FindDynamicAndStringTableSection(Sections []C.Elf64_Shdr) (DynamicSection, StrTabSection *C.Elf64_Shdr, err error) {
+// ReadDynamicSymbols collects the global and weak symbols of .dynsym which
+// other objects can bind to, or which this object expects others to provide.
+func ReadDynamicSymbols(ehdr *elfHeader, symTab, strTab []byte) []ELFSymbol {
+	return ReadSymbols(ehdr, symTab, strTab, true)
+}
+
+// ReadSymbols collects the global and weak symbols of a symbol table. Hidden
+// symbols are only reachable within a link, so they are left out when
+// exportOnly is set.
+func ReadSymbols(ehdr *elfHeader, symTab, strTab []byte, exportOnly bool) (Symbols []ELFSymbol) {
+	var order = ehdr.Order
+	var size = elf64SymSize
+	if elf.Class(ehdr.Class) == elf.ELFCLASS32 {
+		size = elf32SymSize
+	}
+	for off := size; off+size <= len(symTab); off += size { // skip the null symbol
+		var name uint32
+		var info, other byte
+		var shndx uint16
+		if elf.Class(ehdr.Class) == elf.ELFCLASS32 {
+			name = order.Uint32(symTab[off:])
+			info, other = symTab[off+12], symTab[off+13]
+			shndx = order.Uint16(symTab[off+14:])
+		} else {
+			name = order.Uint32(symTab[off:])
+			info, other = symTab[off+4], symTab[off+5]
+			shndx = order.Uint16(symTab[off+6:])
+		}
+		switch elf.ST_TYPE(info) {
+		case elf.STT_SECTION, elf.STT_FILE:
+			continue
+		}
+		var bind = elf.ST_BIND(info)
+		if bind != elf.STB_GLOBAL && bind != elf.STB_WEAK && bind != stbGNUUnique {
+			continue
+		}
+		var defined = elf.SectionIndex(shndx) != elf.SHN_UNDEF
+		if defined && exportOnly {
+			switch elf.ST_VISIBILITY(other) {
+			case elf.STV_DEFAULT, elf.STV_PROTECTED:
+			default:
+				continue
+			}
+		}
+		Symbols = append(Symbols, ELFSymbol{
+			Name:    StringFromTable(strTab, uint64(name)),
+			Defined: defined,
+			Weak:    bind == elf.STB_WEAK,
+		})
+	}
+	return
+}
+
+// DefinedSymbols filters the symbols an object defines.
+func DefinedSymbols(symbols []ELFSymbol) (Defined []ELFSymbol) {
+	for _, symbol := range symbols {
+		if symbol.Defined {
+			Defined = append(Defined, symbol)
+		}
+	}
+	return
+}
+
+func FindDynamicAndStringTableSection(Sections []elfSection) (DynamicSection, StrTabSection *elfSection, err error) {
 	for i := range Sections {
-		if Sections[i].sh_type == C.SHT_DYNAMIC {
+		if elf.SectionType(Sections[i].Type) == elf.SHT_DYNAMIC {
+			if int(Sections[i].Link) >= len(Sections) {
+				err = errors.New("no STRTAB linked to DYNAMIC")
+				return
+			}
 			DynamicSection = &Sections[i]
-			StrTabSection = &Sections[Sections[i].sh_link]
-			if StrTabSection.sh_type != C.SHT_STRTAB {
+			StrTabSection = &Sections[Sections[i].Link]
+			if elf.SectionType(StrTabSection.Type) != elf.SHT_STRTAB {
 				err = errors.New("no STRTAB linked to DYNAMIC")
 				return
 			}
@@ -167,11 +1041,10 @@ func FindDynamicAndStringTableSection(Sections []C.Elf64_Shdr) (DynamicSection,
 	return
 }
 
-func a2i(a [8]byte) uint64 {
-	return binary.LittleEndian.Uint64(a[:])
-}
-
 func StringFromTable(strTab []byte, begin uint64) string {
+	if begin >= uint64(len(strTab)) {
+		return ""
+	}
 	var end int
 	for end = int(begin); end != len(strTab); end++ {
 		if strTab[end] == 0 { // find '\0' character
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"runtime/debug"
+)
+
+// GoModule is a module linked into a Go executable, as recorded by the Go
+// linker in runtime/debug.BuildInfo.
+type GoModule struct {
+	Path           string
+	Version        string
+	Sum            string
+	Main           bool
+	ReplacePath    string
+	ReplaceVersion string
+}
+
+// Layout of the .go.buildinfo section, see debug/buildinfo.
+const (
+	goBuildInfoMagic      = "\xff Go buildinf:"
+	goBuildInfoHeaderSize = 32
+	goBuildInfoBigEndian  = 0x1 // pointers are big endian
+	goBuildInfoInline     = 0x2 // strings follow the header, Go 1.18 and later
+	goBuildInfoMaxString  = 1 << 20
+)
+
+// ReadGoBuildInfo decodes the Go version and the module list from the
+// .go.buildinfo section. Before Go 1.18 the header points to the strings
+// by their virtual addresses, which are looked up through the segments.
+func ReadGoBuildInfo(buffer *UDFR, segments []elfSegment, data []byte, info *ELFSOInfo) error {
+	if len(data) < goBuildInfoHeaderSize || !bytes.HasPrefix(data, []byte(goBuildInfoMagic)) {
+		return nil
+	}
+	var ptrSize = int(data[14])
+	var flags = data[15]
+
+	var version, modinfo string
+	if flags&goBuildInfoInline != 0 {
+		var rest = data[goBuildInfoHeaderSize:]
+		version, rest = readGoVarString(rest)
+		modinfo, _ = readGoVarString(rest)
+	} else {
+		if ptrSize != 4 && ptrSize != 8 || len(data) < 16+2*ptrSize {
+			return errors.New("bad .go.buildinfo header")
+		}
+		var order binary.ByteOrder = binary.LittleEndian
+		if flags&goBuildInfoBigEndian != 0 {
+			order = binary.BigEndian
+		}
+		var err error
+		version, err = readGoString(buffer, segments, order, ptrSize, readGoPointer(order, ptrSize, data[16:]))
+		if err != nil {
+			return err
+		}
+		modinfo, err = readGoString(buffer, segments, order, ptrSize, readGoPointer(order, ptrSize, data[16+ptrSize:]))
+		if err != nil {
+			return err
+		}
+	}
+
+	info.GoVersion = version
+	// The module information is wrapped by 16 byte sentinels, which are
+	// there for the older tools scanning the whole file for it.
+	if len(modinfo) >= 33 && modinfo[len(modinfo)-17] == '\n' {
+		modinfo = modinfo[16 : len(modinfo)-16]
+	}
+	if modinfo == "" {
+		return nil
+	}
+	buildInfo, err := debug.ParseBuildInfo(modinfo)
+	if err != nil {
+		return nil // written by a toolchain we do not understand, keep the version
+	}
+	if buildInfo.Main.Path != "" {
+		info.GoModules = append(info.GoModules, NewGoModule(&buildInfo.Main, true))
+	}
+	for _, dep := range buildInfo.Deps {
+		info.GoModules = append(info.GoModules, NewGoModule(dep, false))
+	}
+	return nil
+}
+
+func NewGoModule(module *debug.Module, main bool) GoModule {
+	var goModule = GoModule{
+		Path:    module.Path,
+		Version: module.Version,
+		Sum:     module.Sum,
+		Main:    main,
+	}
+	if module.Replace != nil {
+		goModule.ReplacePath = module.Replace.Path
+		goModule.ReplaceVersion = module.Replace.Version
+	}
+	return goModule
+}
+
+// readGoVarString reads a string prefixed by its uvarint length.
+func readGoVarString(buf []byte) (string, []byte) {
+	length, n := binary.Uvarint(buf)
+	if n <= 0 || length > uint64(len(buf)-n) {
+		return "", nil
+	}
+	return string(buf[n : n+int(length)]), buf[n+int(length):]
+}
+
+func readGoPointer(order binary.ByteOrder, ptrSize int, buf []byte) uint64 {
+	if ptrSize == 4 {
+		return uint64(order.Uint32(buf))
+	}
+	return order.Uint64(buf)
+}
+
+// readGoString reads the Go string header (data pointer and length) at
+// addr and then the string data it points to.
+func readGoString(buffer *UDFR, segments []elfSegment, order binary.ByteOrder, ptrSize int, addr uint64) (string, error) {
+	offset, ok := AddressToOffset(segments, addr)
+	if !ok {
+		return "", errors.New("no PT_LOAD maps Go string header")
+	}
+	header, err := readRange(buffer, offset, uint64(2*ptrSize))
+	if err != nil {
+		return "", err
+	}
+	offset, ok = AddressToOffset(segments, readGoPointer(order, ptrSize, header))
+	if !ok {
+		return "", errors.New("no PT_LOAD maps Go string data")
+	}
+	var length = readGoPointer(order, ptrSize, header[ptrSize:])
+	if length > goBuildInfoMaxString {
+		return "", errors.New("Go string is too long")
+	}
+	data, err := readRange(buffer, offset, length)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
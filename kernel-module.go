@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+const FindingNoFirmware = "missing-firmware"
+
+// ModInfo is an entry of the .modinfo section of a kernel module, such as
+// alias=pci:v00008086d000010D3sv*sd*bc*sc*i* or firmware=e100/d101m_ucode.bin.
+type ModInfo struct {
+	Key   string
+	Value string
+}
+
+// ReadModInfo splits the .modinfo section into its entries. The module list
+// of depends= is split, so that each dependency gets an entry.
+func ReadModInfo(modinfo []byte) (Entries []ModInfo) {
+	for _, entry := range strings.Split(string(modinfo), "\x00") {
+		eq := strings.IndexByte(entry, '=')
+		if eq <= 0 {
+			continue
+		}
+		key, value := entry[:eq], entry[eq+1:]
+		if key != "depends" {
+			Entries = append(Entries, ModInfo{Key: key, Value: value})
+			continue
+		}
+		for _, module := range strings.Split(value, ",") {
+			if module != "" {
+				Entries = append(Entries, ModInfo{Key: key, Value: module})
+			}
+		}
+	}
+	return
+}
+
+// IsKernelModule tells kernel modules, which may be compressed, by their
+// file names.
+func IsKernelModule(file string) bool {
+	for _, suffix := range []string{".ko", ".ko.gz", ".ko.xz", ".ko.zst"} {
+		if strings.HasSuffix(file, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Directories the kernel loads firmware from, see
+// Documentation/driver-api/firmware/fw_search_path.rst.
+var firmwareDirs = []string{
+	"/lib/firmware/updates",
+	"/lib/firmware",
+}
+
+// checkFirmware reports firmware files requested by kernel modules, which
+// are shipped by no package of the repository, neither plain nor compressed.
+func checkFirmware() error {
+	requests, err := dbModInfo("firmware")
+	if err != nil {
+		return err
+	}
+	var shipped = make(map[string]bool)
+	var findings []Finding
+	for _, request := range requests {
+		found, checked := shipped[request.Value]
+		if !checked {
+			if found, err = FirmwareShipped(request.Value); err != nil {
+				return err
+			}
+			shipped[request.Value] = found
+		}
+		if !found {
+			findings = append(findings, Finding{
+				ELFObjectKey: request.ELFObjectKey,
+				Kind:         FindingNoFirmware,
+				Subject:      request.Value,
+			})
+		}
+	}
+
+	fmt.Printf("Firmware: %d requests checked, %d findings\n", len(requests), len(findings))
+	return dbReplaceFindings([]string{FindingNoFirmware}, findings)
+}
+
+// FirmwareShipped looks for a firmware file in all the firmware directories.
+func FirmwareShipped(firmware string) (bool, error) {
+	for _, dir := range firmwareDirs {
+		for _, suffix := range []string{"", ".xz", ".zst"} {
+			for _, file := range MergedUsrAliases(path.Join(dir, firmware) + suffix) {
+				if found, err := dbFileShipped(file); err != nil || found {
+					return found, err
+				}
+			}
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"debug/elf"
+	"fmt"
+	"path"
+	"strings"
+)
+
+const (
+	FindingUndefinedSymbol = "undefined-symbol"
+	FindingUnusedNeeded    = "unused-needed"
+	FindingNoInterpreter   = "missing-interpreter"
+)
+
+// providerKey tells libraries apart by their ABI as well as their SONAME:
+// x32 and amd64 share EM_X86_64, and ppc64 and ppc64el, mips and mipsel
+// differ only in the byte order.
+type providerKey struct {
+	Machine int
+	Class   int
+	Data    int
+	SoName  string
+}
+
+func newProviderKey(obj *ELFSOInfo, soname string) providerKey {
+	return providerKey{Machine: obj.Machine, Class: obj.Class, Data: obj.Data, SoName: soname}
+}
+
+// IsPlugin tells shared objects loaded by dlopen, such as Python extension
+// modules, whose undefined symbols come from the program loading them. They
+// have no SONAME, which no library linked against should lack, and unlike
+// PIE executables no PT_INTERP. The library directories cannot tell them
+// apart, as /usr/lib holds the plugins of most programs.
+func IsPlugin(obj *ELFSOInfo) bool {
+	return obj.Type == int(elf.ET_DYN) && obj.SoName == "" && obj.Interpreter == ""
+}
+
+// checkLinkage resolves the imported symbols of every ELF object against the
+// exports of the libraries in its DT_NEEDED closure. Imports nobody in the
+// closure exports are reported as undefined symbols (underlinking), NEEDED
+// libraries none of the imports bind to are reported as unused (overlinking).
+func checkLinkage() error {
+	objects, err := dbELFObjects()
+	if err != nil {
+		return err
+	}
+	findings, checked, err := findLinkageProblems(objects, dbELFSymbols)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Linkage: %d objects checked, %d findings\n", checked, len(findings))
+	return dbReplaceFindings([]string{FindingUndefinedSymbol, FindingUnusedNeeded}, findings)
+}
+
+// findLinkageProblems does the work of checkLinkage, reading the defined or
+// undefined dynamic symbols of an object through symbolsOf. It returns the
+// number of objects checked as well. Objects without .dynsym, such as those
+// sstrip leaves, import and export nothing known, so they are not checked,
+// and closures containing them are incomplete.
+func findLinkageProblems(objects map[ELFObjectKey]*ELFSOInfo, symbolsOf func(ELFObjectKey, bool) ([]ELFSymbol, error)) ([]Finding, int, error) {
+	// Libraries in the default search path, by SONAME
+	var providers = make(map[providerKey][]ELFObjectKey)
+	for key, obj := range objects {
+		if obj.SoName != "" && InRPath(key.Path) {
+			soKey := newProviderKey(obj, obj.SoName)
+			providers[soKey] = append(providers[soKey], key)
+		}
+	}
+
+	var exports = make(map[ELFObjectKey]map[string]bool)
+	exportsOf := func(key ELFObjectKey) (map[string]bool, error) {
+		if symbols, exist := exports[key]; exist {
+			return symbols, nil
+		}
+		defined, err := symbolsOf(key, true)
+		if err != nil {
+			return nil, err
+		}
+		var symbols = make(map[string]bool, len(defined))
+		for _, symbol := range defined {
+			symbols[symbol.Name] = true
+		}
+		exports[key] = symbols
+		return symbols, nil
+	}
+
+	var findings []Finding
+	var checked int
+	for key, obj := range objects {
+		if obj.Type != int(elf.ET_EXEC) && obj.Type != int(elf.ET_DYN) || !obj.DynSym {
+			continue
+		}
+		imports, err := symbolsOf(key, false)
+		if err != nil {
+			return nil, 0, err
+		}
+		checked++
+
+		// Breadth first, as the dynamic linker does
+		var closure []ELFObjectKey
+		var complete = true
+		var visited = make(map[string]bool)
+		var queue = append([]string(nil), obj.Needed...)
+		for len(queue) != 0 {
+			soname := queue[0]
+			queue = queue[1:]
+			if visited[soname] {
+				continue
+			}
+			visited[soname] = true
+			libs := providers[newProviderKey(obj, soname)]
+			if len(libs) == 0 {
+				complete = false
+				continue
+			}
+			for _, lib := range libs {
+				if !objects[lib].DynSym {
+					complete = false
+				}
+				closure = append(closure, lib)
+				queue = append(queue, objects[lib].Needed...)
+			}
+		}
+
+		// Overlinking: direct dependencies which no import binds to
+		for _, soname := range obj.Needed {
+			libs := providers[newProviderKey(obj, soname)]
+			if len(libs) == 0 || !allDynSym(objects, libs) {
+				continue
+			}
+			var used bool
+		USED:
+			for _, lib := range libs {
+				symbols, err := exportsOf(lib)
+				if err != nil {
+					return nil, 0, err
+				}
+				for _, symbol := range imports {
+					if symbols[symbol.Name] {
+						used = true
+						break USED
+					}
+				}
+			}
+			if !used {
+				findings = append(findings, Finding{
+					ELFObjectKey: key,
+					Kind:         FindingUnusedNeeded,
+					Subject:      soname,
+				})
+			}
+		}
+
+		// Underlinking: strong imports which nothing in the closure exports.
+		// Skipped when part of the closure is not in the repository, and for
+		// plugins.
+		if !complete || IsPlugin(obj) {
+			continue
+		}
+	IMPORTS:
+		for _, symbol := range imports {
+			if symbol.Weak {
+				continue
+			}
+			for _, lib := range closure {
+				symbols, err := exportsOf(lib)
+				if err != nil {
+					return nil, 0, err
+				}
+				if symbols[symbol.Name] {
+					continue IMPORTS
+				}
+			}
+			findings = append(findings, Finding{
+				ELFObjectKey: key,
+				Kind:         FindingUndefinedSymbol,
+				Subject:      symbol.Name,
+			})
+		}
+	}
+
+	return findings, checked, nil
+}
+
+// allDynSym reports whether all the libraries have .dynsym.
+func allDynSym(objects map[ELFObjectKey]*ELFSOInfo, libs []ELFObjectKey) bool {
+	for _, lib := range libs {
+		if !objects[lib].DynSym {
+			return false
+		}
+	}
+	return true
+}
+
+// checkInterpreters reports executables whose requested dynamic linker
+// (PT_INTERP) is shipped by no package of the repository.
+func checkInterpreters() error {
+	objects, err := dbInterpreters()
+	if err != nil {
+		return err
+	}
+	var shipped = make(map[string]bool)
+	var findings []Finding
+	for key, obj := range objects {
+		found, checked := shipped[obj.Interpreter]
+		if !checked {
+			for _, file := range MergedUsrAliases(obj.Interpreter) {
+				if found, err = dbFileShipped(file); err != nil {
+					return err
+				} else if found {
+					break
+				}
+			}
+			shipped[obj.Interpreter] = found
+		}
+		if !found {
+			findings = append(findings, Finding{
+				ELFObjectKey: key,
+				Kind:         FindingNoInterpreter,
+				Subject:      obj.Interpreter,
+				Detail:       obj.Libc,
+			})
+		}
+	}
+
+	fmt.Printf("Interpreters: %d executables checked, %d findings\n", len(objects), len(findings))
+	return dbReplaceFindings([]string{FindingNoInterpreter}, findings)
+}
+
+// MergedUsrAliases returns the paths a file can be shipped as on a merged-/usr
+// system, where /bin, /sbin and /lib* are symbolic links into /usr.
+func MergedUsrAliases(file string) []string {
+	file = path.Clean(file)
+	var aliases = []string{file}
+	for _, dir := range []string{"/bin/", "/sbin/", "/lib"} {
+		if strings.HasPrefix(file, dir) {
+			aliases = append(aliases, "/usr"+file)
+		}
+		if strings.HasPrefix(file, "/usr"+dir) {
+			aliases = append(aliases, strings.TrimPrefix(file, "/usr"))
+		}
+	}
+	return aliases
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// TestLinkageSectionHeadersStripped checks that an object whose section
+// headers are gone, as after sstrip, is not reported for the NEEDED entries
+// it has no .dynsym to match against.
+func TestLinkageSectionHeadersStripped(t *testing.T) {
+	if _, err := exec.LookPath("gcc"); err != nil {
+		t.Skip("gcc not found")
+	}
+	dir, err := ioutil.TempDir("", "linkage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var source = filepath.Join(dir, "hello.c")
+	var executable = filepath.Join(dir, "hello")
+	if err := ioutil.WriteFile(source, []byte("#include <stdio.h>\nint main(void) { puts(\"hello\"); return 0; }\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command("gcc", "-o", executable, source).CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	hello, err := ioutil.ReadFile(executable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elf.Class(hello[elf.EI_CLASS]) != elf.ELFCLASS64 || elf.Data(hello[elf.EI_DATA]) != elf.ELFDATA2LSB {
+		t.Skip("not a little-endian 64-bit toolchain")
+	}
+
+	var full ELFSOInfo
+	if err := analyseELF(bytes.NewReader(hello), int64(len(hello)), &full); err != nil {
+		t.Fatal(err)
+	}
+	if !full.DynSym || len(full.Needed) == 0 {
+		t.Fatalf("unstripped: DynSym %v, NEEDED %v", full.DynSym, full.Needed)
+	}
+
+	// What sstrip leaves: e_shoff, e_shnum and e_shstrndx cleared
+	var stripped = append([]byte(nil), hello...)
+	for i := 0x28; i < 0x30; i++ {
+		stripped[i] = 0
+	}
+	for i := 0x3c; i < 0x40; i++ {
+		stripped[i] = 0
+	}
+	var info ELFSOInfo
+	if err := analyseELF(bytes.NewReader(stripped), int64(len(stripped)), &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.DynSym || len(info.Needed) == 0 {
+		t.Fatalf("stripped: DynSym %v, NEEDED %v", info.DynSym, info.Needed)
+	}
+
+	// A libc which exports none of the imports of hello
+	var objects = make(map[ELFObjectKey]*ELFSOInfo)
+	var libcKey = ELFObjectKey{Package: "libc", Version: "1", Architecture: "amd64", Path: "/usr/lib/x86_64-linux-gnu/" + full.Needed[0]}
+	objects[libcKey] = &ELFSOInfo{
+		Class:   full.Class,
+		Data:    full.Data,
+		Type:    int(elf.ET_DYN),
+		Machine: full.Machine,
+		SoName:  full.Needed[0],
+		DynSym:  true,
+	}
+	var helloKey = ELFObjectKey{Package: "hello", Version: "1", Architecture: "amd64", Path: "/usr/bin/hello"}
+	symbolsOf := func(key ELFObjectKey, defined bool) ([]ELFSymbol, error) {
+		if key != helloKey {
+			if !defined {
+				return nil, nil
+			}
+			return []ELFSymbol{{Name: "unrelated", Defined: true}}, nil
+		}
+		var symbols []ELFSymbol
+		for _, symbol := range objects[key].Symbols {
+			if symbol.Defined == defined {
+				symbols = append(symbols, symbol)
+			}
+		}
+		return symbols, nil
+	}
+
+	objects[helloKey] = &full
+	findings, checked, err := findLinkageProblems(objects, symbolsOf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checked != 2 || len(findings) == 0 {
+		t.Fatalf("unstripped: %d checked, findings %v", checked, findings)
+	}
+
+	objects[helloKey] = &info
+	findings, checked, err = findLinkageProblems(objects, symbolsOf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checked != 1 || len(findings) != 0 {
+		t.Fatalf("stripped: %d checked, findings %v", checked, findings)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"log"
 	"os"
 	"os/signal"
@@ -11,7 +12,14 @@ func main() {
 	var intCh = make(chan os.Signal, 1)
 	signal.Notify(intCh, os.Interrupt)
 
-	if len(os.Args) != 3 {
+	flag.Int64Var(&ReadAheadSize, "read-ahead", ReadAheadSize,
+		"compressed `size` from which xz members are decoded ahead of the scan, 0 disables it")
+	flag.Int64Var(&ParallelSize, "parallel", ParallelSize,
+		"compressed `size` from which gzip and xz members are decoded by several goroutines, 0 disables it")
+	flag.Int64Var(&XzParallelBudget, "xz-budget", XzParallelBudget,
+		"decoded `bytes` a parallel xz member may hold at once")
+	flag.Parse()
+	if flag.NArg() != 2 {
 		log.Fatalln("not enough arguments")
 	}
 
@@ -25,7 +33,22 @@ func main() {
 	if err != nil {
 		log.Fatalln(err)
 	}
-	dbInit(pwd, os.Args[2])
-	os.Chdir(os.Args[1])
+	dbInit(pwd, flag.Arg(1))
+	os.Chdir(flag.Arg(0))
 	scan()
+	if err := checkLinkage(); err != nil {
+		log.Fatalln(err)
+	}
+	if err := checkInterpreters(); err != nil {
+		log.Fatalln(err)
+	}
+	if err := checkDebugSymbols(); err != nil {
+		log.Fatalln(err)
+	}
+	if err := checkArchitectures(); err != nil {
+		log.Fatalln(err)
+	}
+	if err := checkFirmware(); err != nil {
+		log.Fatalln(err)
+	}
 }
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"debug/pe"
+	"encoding/binary"
+	"errors"
+	"io"
+	"path"
+	"strings"
+)
+
+// PESOInfo describes a PE/COFF executable or DLL, as shipped by the
+// mingw-w64 cross packages.
+type PESOInfo struct {
+	Path    string
+	Machine int
+	DLL     bool
+	Name    string   // DLL name of the export directory
+	Imports []string // imported DLLs, in lower case
+	Exports []string // exported symbols by name
+
+	// Filled in by JobPEDependencyFinal, which sees the whole package.
+	Depends []string // imported DLLs the package does not ship itself
+}
+
+var ErrNotAPE = errors.New("not a PE file")
+
+// Sizes and offsets of the PE structures we decode, see the PE format
+// specification.
+const (
+	peDOSHeaderSize     = 0x40
+	peDOSHeaderLfanew   = 0x3c
+	peCOFFHeaderSize    = 20
+	peSectionHeaderSize = 40
+	peImportDescSize    = 20
+	peExportDirSize     = 40
+	peDataDirEntrySize  = 8
+	peDataDirOffset32   = 96
+	peDataDirOffset64   = 112
+	peOptionalMagic32   = 0x10b
+	peOptionalMagic64   = 0x20b
+	peMaxSectionSize    = 64 * 1024 * 1024
+
+	peDOSSignature = "MZ"
+	peSignature    = "PE\x00\x00"
+)
+
+type peSection struct {
+	VirtualAddress   uint32
+	VirtualSize      uint32
+	SizeOfRawData    uint32
+	PointerToRawData uint32
+}
+
+// peImage maps relative virtual addresses (RVA) to the section data, which
+// is read once per section.
+type peImage struct {
+	buffer   *UDFR
+	sections []peSection
+	data     map[int][]byte
+}
+
+// IsPEFile tells PE executables and DLLs by their file names.
+func IsPEFile(file string) bool {
+	var ext = strings.ToLower(path.Ext(file))
+	return ext == ".dll" || ext == ".exe"
+}
+
+func analysePE(input io.Reader, info *PESOInfo) error {
+	return readPE(NewUDFR(input), info)
+}
+
+func readPE(buffer *UDFR, info *PESOInfo) error {
+	var order = binary.LittleEndian
+
+	buf, err := readPERange(buffer, 0, peDOSHeaderSize)
+	if err != nil || string(buf[:2]) != peDOSSignature {
+		return ErrNotAPE
+	}
+	var peOffset = uint64(order.Uint32(buf[peDOSHeaderLfanew:]))
+
+	buf, err = readPERange(buffer, peOffset, uint64(len(peSignature)+peCOFFHeaderSize))
+	if err != nil || string(buf[:4]) != peSignature {
+		return ErrNotAPE
+	}
+	var coff = buf[4:]
+	info.Machine = int(order.Uint16(coff[0:]))
+	info.DLL = order.Uint16(coff[18:])&pe.IMAGE_FILE_DLL != 0
+	var sectionCount = int(order.Uint16(coff[2:]))
+	var optionalSize = uint64(order.Uint16(coff[16:]))
+
+	// Read the data directories of the optional header
+	var optionalOffset = peOffset + uint64(len(buf))
+	optional, err := readPERange(buffer, optionalOffset, optionalSize)
+	if err != nil {
+		return err
+	}
+	var dirOffset int
+	switch {
+	case len(optional) >= peDataDirOffset32 && order.Uint16(optional) == peOptionalMagic32:
+		dirOffset = peDataDirOffset32
+	case len(optional) >= peDataDirOffset64 && order.Uint16(optional) == peOptionalMagic64:
+		dirOffset = peDataDirOffset64
+	default:
+		return ErrNotAPE
+	}
+	var dirCount = int(order.Uint32(optional[dirOffset-4:]))
+	var dataDirectory = func(index int) (rva, size uint32) {
+		var off = dirOffset + index*peDataDirEntrySize
+		if index >= dirCount || off+peDataDirEntrySize > len(optional) {
+			return 0, 0
+		}
+		return order.Uint32(optional[off:]), order.Uint32(optional[off+4:])
+	}
+
+	// Read section headers
+	var image = peImage{buffer: buffer, data: make(map[int][]byte)}
+	buf, err = readPERange(buffer, optionalOffset+optionalSize, uint64(sectionCount*peSectionHeaderSize))
+	if err != nil {
+		return err
+	}
+	for i := 0; i < sectionCount; i++ {
+		var header = buf[i*peSectionHeaderSize:]
+		image.sections = append(image.sections, peSection{
+			VirtualSize:      order.Uint32(header[8:]),
+			VirtualAddress:   order.Uint32(header[12:]),
+			SizeOfRawData:    order.Uint32(header[16:]),
+			PointerToRawData: order.Uint32(header[20:]),
+		})
+	}
+
+	if rva, size := dataDirectory(pe.IMAGE_DIRECTORY_ENTRY_EXPORT); rva != 0 && size != 0 {
+		if err := image.readExports(rva, info); err != nil {
+			return err
+		}
+	}
+	if rva, size := dataDirectory(pe.IMAGE_DIRECTORY_ENTRY_IMPORT); rva != 0 && size != 0 {
+		if err := image.readImports(rva, info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readExports reads the DLL name and the exported names of the export
+// directory. Symbols exported by ordinal only have no name to record.
+func (image *peImage) readExports(rva uint32, info *PESOInfo) error {
+	var order = binary.LittleEndian
+	dir, err := image.read(rva, peExportDirSize)
+	if err != nil {
+		return err
+	}
+	if info.Name, err = image.readString(order.Uint32(dir[12:])); err != nil {
+		return err
+	}
+	var nameCount = order.Uint32(dir[24:])
+	if nameCount > peMaxSectionSize/4 {
+		return ErrNotAPE
+	}
+	names, err := image.read(order.Uint32(dir[32:]), nameCount*4)
+	if err != nil {
+		return err
+	}
+	for i := uint32(0); i < nameCount; i++ {
+		name, err := image.readString(order.Uint32(names[i*4:]))
+		if err != nil {
+			return err
+		}
+		info.Exports = append(info.Exports, name)
+	}
+	return nil
+}
+
+// readImports walks the import descriptors, which end with a zeroed one.
+func (image *peImage) readImports(rva uint32, info *PESOInfo) error {
+	var order = binary.LittleEndian
+	for ; ; rva += peImportDescSize {
+		desc, err := image.read(rva, peImportDescSize)
+		if err != nil {
+			return err
+		}
+		var nameRVA = order.Uint32(desc[12:])
+		if nameRVA == 0 {
+			return nil
+		}
+		name, err := image.readString(nameRVA)
+		if err != nil {
+			return err
+		}
+		info.Imports = append(info.Imports, strings.ToLower(name))
+	}
+}
+
+// section returns the data of the section which maps rva, and the offset of
+// rva in it.
+func (image *peImage) section(rva uint32) ([]byte, uint32, error) {
+	for i := range image.sections {
+		var s = &image.sections[i]
+		var size = s.VirtualSize
+		if size == 0 || size > s.SizeOfRawData {
+			size = s.SizeOfRawData
+		}
+		if rva < s.VirtualAddress || rva-s.VirtualAddress >= size {
+			continue
+		}
+		data, exist := image.data[i]
+		if !exist {
+			if size > peMaxSectionSize {
+				return nil, 0, errors.New("PE section is too large")
+			}
+			var err error
+			data, err = readPERange(image.buffer, uint64(s.PointerToRawData), uint64(size))
+			if err != nil {
+				return nil, 0, err
+			}
+			image.data[i] = data
+		}
+		return data, rva - s.VirtualAddress, nil
+	}
+	return nil, 0, errors.New("no PE section maps RVA")
+}
+
+func (image *peImage) read(rva, size uint32) ([]byte, error) {
+	data, off, err := image.section(rva)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(off)+uint64(size) > uint64(len(data)) {
+		return nil, ErrNotAPE
+	}
+	return data[off : off+size], nil
+}
+
+func (image *peImage) readString(rva uint32) (string, error) {
+	data, off, err := image.section(rva)
+	if err != nil {
+		return "", err
+	}
+	return StringFromTable(data, uint64(off)), nil
+}
+
+func readPERange(buffer *UDFR, offset, size uint64) ([]byte, error) {
+	if _, err := buffer.Seek(int64(offset), io.SeekStart); err != nil {
+		return nil, ErrNotAPE
+	}
+	var data = make([]byte, size)
+	if n, _ := buffer.Read(data); n != len(data) {
+		return nil, ErrNotAPE
+	}
+	return data, nil
+}
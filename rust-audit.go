@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+// RustCrate is a crate compiled into a Rust binary, as recorded by
+// cargo-auditable.
+type RustCrate struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Source  string `json:"source"`
+	Kind    string `json:"kind"`
+	Root    bool   `json:"root"`
+}
+
+// The decompressed list is limited the same way rust-audit-info does, to
+// keep a malicious section from exhausting the memory.
+const rustAuditMaxSize = 8 * 1024 * 1024
+
+// ReadRustAudit decodes the zlib-compressed JSON of the .dep-v0 section.
+func ReadRustAudit(data []byte) ([]RustCrate, error) {
+	reader, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	buf, err := ioutil.ReadAll(io.LimitReader(reader, rustAuditMaxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) > rustAuditMaxSize {
+		return nil, errors.New(".dep-v0 is too large")
+	}
+
+	var audit struct {
+		Packages []RustCrate `json:"packages"`
+	}
+	if err := json.Unmarshal(buf, &audit); err != nil {
+		return nil, err
+	}
+	for i := range audit.Packages {
+		if audit.Packages[i].Kind == "" {
+			audit.Packages[i].Kind = "runtime" // omitted when it is the default
+		}
+	}
+	return audit.Packages, nil
+}
@@ -2,7 +2,10 @@ package main
 
 import (
 	"database/sql"
+	"debug/elf"
+	"fmt"
 	"log"
+	"path"
 	"path/filepath"
 	"strings"
 	"sync"
@@ -13,6 +16,43 @@ import (
 var DB *sql.DB
 var lockWrite = &sync.Mutex{}
 
+// dbSchemaVersion is kept in PRAGMA user_version. It is bumped whenever the
+// tables change in a way CREATE TABLE IF NOT EXISTS does not apply to an
+// existing database.
+//
+// 1: repository gains architecture and compression, the per-package tables
+// gain architecture after version.
+// 2: elf_objects gains dynsym.
+const dbSchemaVersion = 2
+
+// dbTables are the tables dbInit creates, and dbMigrate may drop.
+var dbTables = []string{
+	"repository",
+	"elf_depends",
+	"elf_provides",
+	"elf_version_depends",
+	"elf_version_provides",
+	"elf_version_minimum",
+	"elf_objects",
+	"hardening_summary",
+	"elf_needed",
+	"elf_symbols",
+	"go_modules",
+	"rust_crates",
+	"kernel_modinfo",
+	"pe_provides",
+	"pe_depends",
+	"pe_objects",
+	"pe_imports",
+	"pe_exports",
+	"static_members",
+	"static_symbols",
+	"findings",
+	"scan_failures",
+	"debug_index",
+	"package_files",
+}
+
 func dbInit(pwd, db string) error {
 	if DB == nil {
 		db, err := sql.Open("sqlite3", "file:"+filepath.Join(pwd, db+".db"))
@@ -20,6 +60,9 @@ func dbInit(pwd, db string) error {
 			return err
 		}
 		DB = db
+		if err := dbMigrate(); err != nil {
+			log.Fatalln(err)
+		}
 		_, err = DB.Exec(
 			`
 PRAGMA journal_mode=WAL;
@@ -30,23 +73,230 @@ CREATE TABLE IF NOT EXISTS repository (
 	hash	TEXT,
 	size	INTEGER,
 	mtime	INTEGER,
-	control TEXT
+	control TEXT,
+	architecture	TEXT,
+	compression	TEXT
 );
 CREATE TABLE IF NOT EXISTS elf_depends (
 	package	TEXT,
 	version	TEXT,
+	architecture	TEXT,
 	depends	TEXT,
 	sover	TEXT
 );
 CREATE TABLE IF NOT EXISTS elf_provides (
 	package	TEXT,
 	version	TEXT,
+	architecture	TEXT,
 	provides	TEXT,
 	sover	TEXT
 );
+CREATE TABLE IF NOT EXISTS elf_version_depends (
+	package	TEXT,
+	version	TEXT,
+	architecture	TEXT,
+	depends	TEXT,
+	sover	TEXT,
+	symver	TEXT
+);
+CREATE TABLE IF NOT EXISTS elf_version_provides (
+	package	TEXT,
+	version	TEXT,
+	architecture	TEXT,
+	provides	TEXT,
+	sover	TEXT,
+	symver	TEXT
+);
+CREATE TABLE IF NOT EXISTS elf_version_minimum (
+	package	TEXT,
+	version	TEXT,
+	architecture	TEXT,
+	depends	TEXT,
+	sover	TEXT,
+	symver	TEXT
+);
+CREATE TABLE IF NOT EXISTS elf_objects (
+	package	TEXT,
+	version	TEXT,
+	architecture	TEXT,
+	path	TEXT,
+	class	INTEGER,
+	data	INTEGER,
+	type	INTEGER,
+	machine	INTEGER,
+	soname	TEXT,
+	rpath	TEXT,
+	runpath	TEXT,
+	interp	TEXT,
+	libc	TEXT,
+	build_id	TEXT,
+	pie	INTEGER,
+	relro	INTEGER,
+	bind_now	INTEGER,
+	nx_stack	INTEGER,
+	stack_protector	INTEGER,
+	fortify	INTEGER,
+	ibt	INTEGER,
+	shstk	INTEGER,
+	textrel	INTEGER,
+	debug_info	INTEGER,
+	symtab	INTEGER,
+	dynsym	INTEGER,
+	comment	TEXT,
+	static	INTEGER,
+	toolchain	TEXT,
+	go_version	TEXT,
+	provides	INTEGER
+);
+CREATE TABLE IF NOT EXISTS hardening_summary (
+	package	TEXT,
+	version	TEXT,
+	architecture	TEXT,
+	objects	INTEGER,
+	executables	INTEGER,
+	pie	INTEGER,
+	relro	INTEGER,
+	bind_now	INTEGER,
+	nx_stack	INTEGER,
+	stack_protector	INTEGER,
+	fortify	INTEGER,
+	ibt	INTEGER,
+	shstk	INTEGER,
+	PRIMARY KEY (package, version, architecture)
+);
+CREATE TABLE IF NOT EXISTS elf_needed (
+	package	TEXT,
+	version	TEXT,
+	architecture	TEXT,
+	path	TEXT,
+	needed	TEXT,
+	external	INTEGER
+);
+CREATE TABLE IF NOT EXISTS elf_symbols (
+	package	TEXT,
+	version	TEXT,
+	architecture	TEXT,
+	path	TEXT,
+	symbol	TEXT,
+	defined	INTEGER,
+	weak	INTEGER
+);
+CREATE TABLE IF NOT EXISTS go_modules (
+	package	TEXT,
+	version	TEXT,
+	architecture	TEXT,
+	path	TEXT,
+	module	TEXT,
+	module_version	TEXT,
+	sum	TEXT,
+	main	INTEGER,
+	replace_module	TEXT,
+	replace_version	TEXT
+);
+CREATE TABLE IF NOT EXISTS rust_crates (
+	package	TEXT,
+	version	TEXT,
+	architecture	TEXT,
+	path	TEXT,
+	crate	TEXT,
+	crate_version	TEXT,
+	source	TEXT,
+	kind	TEXT,
+	root	INTEGER
+);
+CREATE TABLE IF NOT EXISTS kernel_modinfo (
+	package	TEXT,
+	version	TEXT,
+	architecture	TEXT,
+	path	TEXT,
+	key	TEXT,
+	value	TEXT
+);
+CREATE TABLE IF NOT EXISTS pe_provides (
+	package	TEXT,
+	version	TEXT,
+	architecture	TEXT,
+	provides	TEXT
+);
+CREATE TABLE IF NOT EXISTS pe_depends (
+	package	TEXT,
+	version	TEXT,
+	architecture	TEXT,
+	depends	TEXT
+);
+CREATE TABLE IF NOT EXISTS pe_objects (
+	package	TEXT,
+	version	TEXT,
+	architecture	TEXT,
+	path	TEXT,
+	machine	INTEGER,
+	dll	INTEGER,
+	name	TEXT
+);
+CREATE TABLE IF NOT EXISTS pe_imports (
+	package	TEXT,
+	version	TEXT,
+	architecture	TEXT,
+	path	TEXT,
+	dll	TEXT,
+	external	INTEGER
+);
+CREATE TABLE IF NOT EXISTS pe_exports (
+	package	TEXT,
+	version	TEXT,
+	architecture	TEXT,
+	path	TEXT,
+	symbol	TEXT
+);
+CREATE TABLE IF NOT EXISTS static_members (
+	package	TEXT,
+	version	TEXT,
+	architecture	TEXT,
+	path	TEXT,
+	member	TEXT,
+	machine	INTEGER
+);
+CREATE TABLE IF NOT EXISTS static_symbols (
+	package	TEXT,
+	version	TEXT,
+	architecture	TEXT,
+	path	TEXT,
+	member	TEXT,
+	symbol	TEXT,
+	weak	INTEGER
+);
+CREATE TABLE IF NOT EXISTS findings (
+	package	TEXT,
+	version	TEXT,
+	architecture	TEXT,
+	path	TEXT,
+	kind	TEXT,
+	subject	TEXT,
+	detail	TEXT
+);
+CREATE TABLE IF NOT EXISTS scan_failures (
+	filename	TEXT PRIMARY KEY,
+	mtime	INTEGER,
+	package	TEXT,
+	version	TEXT,
+	stage	TEXT,
+	error	TEXT
+);
+CREATE TABLE IF NOT EXISTS debug_index (
+	build_id	TEXT,
+	package	TEXT,
+	version	TEXT,
+	architecture	TEXT,
+	path	TEXT,
+	debug_package	TEXT,
+	debug_version	TEXT,
+	debug_architecture	TEXT,
+	debug_path	TEXT
+);
 CREATE TABLE IF NOT EXISTS package_files (
 	package	TEXT,
 	version	TEXT,
+	architecture	TEXT,
 	path	TEXT,
 	name	TEXT,
 	size	INTEGER,
@@ -57,21 +307,170 @@ CREATE TABLE IF NOT EXISTS package_files (
 );
 CREATE INDEX IF NOT EXISTS idx_elf_depends_pkg ON elf_depends (
 	package,
-	version
+	version,
+	architecture
 );
 CREATE INDEX IF NOT EXISTS idx_elf_depends ON elf_depends (
 	depends
 );
 CREATE INDEX IF NOT EXISTS idx_elf_provides_pkg ON elf_provides (
 	package,
-	version
+	version,
+	architecture
 );
 CREATE INDEX IF NOT EXISTS idx_elf_provides ON elf_provides (
 	provides
 );
+CREATE INDEX IF NOT EXISTS idx_elf_version_depends_pkg ON elf_version_depends (
+	package,
+	version,
+	architecture
+);
+CREATE INDEX IF NOT EXISTS idx_elf_version_depends ON elf_version_depends (
+	symver
+);
+CREATE INDEX IF NOT EXISTS idx_elf_version_provides_pkg ON elf_version_provides (
+	package,
+	version,
+	architecture
+);
+CREATE INDEX IF NOT EXISTS idx_elf_version_provides ON elf_version_provides (
+	symver
+);
+CREATE INDEX IF NOT EXISTS idx_elf_version_minimum_pkg ON elf_version_minimum (
+	package,
+	version,
+	architecture
+);
+CREATE INDEX IF NOT EXISTS idx_elf_version_minimum ON elf_version_minimum (
+	symver
+);
+CREATE INDEX IF NOT EXISTS idx_elf_objects_pkg ON elf_objects (
+	package,
+	version,
+	architecture
+);
+CREATE INDEX IF NOT EXISTS idx_elf_objects_machine ON elf_objects (
+	machine
+);
+CREATE INDEX IF NOT EXISTS idx_elf_objects_soname ON elf_objects (
+	soname
+);
+CREATE INDEX IF NOT EXISTS idx_elf_objects_static ON elf_objects (
+	static
+);
+CREATE INDEX IF NOT EXISTS idx_elf_needed_pkg ON elf_needed (
+	package,
+	version,
+	architecture
+);
+CREATE INDEX IF NOT EXISTS idx_elf_needed ON elf_needed (
+	needed
+);
+CREATE INDEX IF NOT EXISTS idx_findings_pkg ON findings (
+	package,
+	version,
+	architecture
+);
+CREATE INDEX IF NOT EXISTS idx_findings ON findings (
+	kind
+);
+CREATE INDEX IF NOT EXISTS idx_elf_symbols_pkg ON elf_symbols (
+	package,
+	version,
+	architecture
+);
+CREATE INDEX IF NOT EXISTS idx_elf_symbols ON elf_symbols (
+	symbol
+);
+CREATE INDEX IF NOT EXISTS idx_go_modules_pkg ON go_modules (
+	package,
+	version,
+	architecture
+);
+CREATE INDEX IF NOT EXISTS idx_go_modules ON go_modules (
+	module,
+	module_version
+);
+CREATE INDEX IF NOT EXISTS idx_rust_crates_pkg ON rust_crates (
+	package,
+	version,
+	architecture
+);
+CREATE INDEX IF NOT EXISTS idx_rust_crates ON rust_crates (
+	crate,
+	crate_version
+);
+CREATE INDEX IF NOT EXISTS idx_kernel_modinfo_pkg ON kernel_modinfo (
+	package,
+	version,
+	architecture
+);
+CREATE INDEX IF NOT EXISTS idx_kernel_modinfo ON kernel_modinfo (
+	key,
+	value
+);
+CREATE INDEX IF NOT EXISTS idx_pe_provides_pkg ON pe_provides (
+	package,
+	version,
+	architecture
+);
+CREATE INDEX IF NOT EXISTS idx_pe_provides ON pe_provides (
+	provides
+);
+CREATE INDEX IF NOT EXISTS idx_pe_depends_pkg ON pe_depends (
+	package,
+	version,
+	architecture
+);
+CREATE INDEX IF NOT EXISTS idx_pe_depends ON pe_depends (
+	depends
+);
+CREATE INDEX IF NOT EXISTS idx_pe_objects_pkg ON pe_objects (
+	package,
+	version,
+	architecture
+);
+CREATE INDEX IF NOT EXISTS idx_pe_imports_pkg ON pe_imports (
+	package,
+	version,
+	architecture
+);
+CREATE INDEX IF NOT EXISTS idx_pe_exports_pkg ON pe_exports (
+	package,
+	version,
+	architecture
+);
+CREATE INDEX IF NOT EXISTS idx_pe_exports ON pe_exports (
+	symbol
+);
+CREATE INDEX IF NOT EXISTS idx_static_members_pkg ON static_members (
+	package,
+	version,
+	architecture
+);
+CREATE INDEX IF NOT EXISTS idx_static_symbols_pkg ON static_symbols (
+	package,
+	version,
+	architecture
+);
+CREATE INDEX IF NOT EXISTS idx_static_symbols ON static_symbols (
+	symbol
+);
+CREATE INDEX IF NOT EXISTS idx_elf_objects_build_id ON elf_objects (
+	build_id
+);
+CREATE INDEX IF NOT EXISTS idx_debug_index ON debug_index (
+	build_id
+);
 CREATE INDEX IF NOT EXISTS idx_package_files ON package_files (
 	package,
-	version
+	version,
+	architecture
+);
+CREATE INDEX IF NOT EXISTS idx_package_files_name ON package_files (
+	name,
+	path
 );
 `)
 		if err != nil {
@@ -81,6 +480,35 @@ CREATE INDEX IF NOT EXISTS idx_package_files ON package_files (
 	return nil
 }
 
+// dbMigrate brings a database written by an older scanner up to date. Rows
+// written before a column existed lack what it records, such as the
+// architecture telling them apart, so the scanner's own tables are dropped
+// and every package is scanned again. Other tables in the database file are
+// left alone.
+func dbMigrate() error {
+	var version int
+	if err := DB.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version >= dbSchemaVersion {
+		return nil
+	}
+	var scanned int
+	if err := DB.QueryRow("SELECT count(*) FROM sqlite_master WHERE type='table' AND name='repository'").Scan(&scanned); err != nil {
+		return err
+	}
+	if scanned != 0 {
+		log.Printf("database schema %d is outdated, scanning everything again", version)
+	}
+	for _, table := range dbTables {
+		if _, err := DB.Exec("DROP TABLE IF EXISTS " + table); err != nil {
+			return err
+		}
+	}
+	_, err := DB.Exec(fmt.Sprintf("PRAGMA user_version = %d", dbSchemaVersion))
+	return err
+}
+
 func dbExists(info *PackageInfo) (bool, error) {
 	rows, err := DB.Query("SELECT * FROM repository WHERE filename=? AND mtime=?", info.Filename, info.Mtime, info.Deb822)
 	if err != nil {
@@ -99,7 +527,8 @@ func dbInsert(info *PackageInfo) error {
 	defer lockWrite.Unlock()
 	{
 		if _, err = tx.Exec(
-			"INSERT OR REPLACE INTO repository VALUES(?,?,?,?,?,?,?)",
+			"INSERT OR REPLACE INTO repository (filename, package, version, hash, size, mtime, "+
+				"control, architecture, compression) VALUES(?,?,?,?,?,?,?,?,?)",
 			info.Filename,
 			info.Package,
 			info.Version,
@@ -107,18 +536,26 @@ func dbInsert(info *PackageInfo) error {
 			info.Size,
 			info.Mtime,
 			info.Deb822,
+			info.Architecture,
+			info.Compression,
 		); err != nil {
 			return err
 		}
+		if _, err = tx.Exec("DELETE FROM scan_failures WHERE filename=?", info.Filename); err != nil {
+			return err
+		}
 
+		// elf_provides and elf_depends are the package level summary of the
+		// per-object rows: elf_objects.provides and elf_needed.external.
 		if _, err = tx.Exec(
-			"DELETE FROM elf_provides WHERE package=? AND version=?",
+			"DELETE FROM elf_provides WHERE package=? AND version=? AND architecture=?",
 			info.Package,
 			info.Version,
+			info.Architecture,
 		); err != nil {
 			return err
 		}
-		stmt1, err := tx.Prepare("INSERT INTO elf_provides VALUES(?,?,?,?)")
+		stmt1, err := tx.Prepare("INSERT INTO elf_provides (package, version, architecture, provides, sover) VALUES(?,?,?,?,?)")
 		if err != nil {
 			return err
 		}
@@ -128,6 +565,7 @@ func dbInsert(info *PackageInfo) error {
 			if _, err := stmt1.Exec(
 				info.Package,
 				info.Version,
+				info.Architecture,
 				name,
 				sover,
 			); err != nil {
@@ -136,13 +574,14 @@ func dbInsert(info *PackageInfo) error {
 		}
 
 		if _, err = tx.Exec(
-			"DELETE FROM elf_depends WHERE package=? AND version=?",
+			"DELETE FROM elf_depends WHERE package=? AND version=? AND architecture=?",
 			info.Package,
 			info.Version,
+			info.Architecture,
 		); err != nil {
 			return err
 		}
-		stmt2, err := tx.Prepare("INSERT INTO elf_depends VALUES(?,?,?,?)")
+		stmt2, err := tx.Prepare("INSERT INTO elf_depends (package, version, architecture, depends, sover) VALUES(?,?,?,?,?)")
 		if err != nil {
 			return err
 		}
@@ -152,6 +591,7 @@ func dbInsert(info *PackageInfo) error {
 			_, err := stmt2.Exec(
 				info.Package,
 				info.Version,
+				info.Architecture,
 				name,
 				sover,
 			)
@@ -161,13 +601,15 @@ func dbInsert(info *PackageInfo) error {
 		}
 
 		if _, err = tx.Exec(
-			"DELETE FROM package_files WHERE package=? AND version=?",
+			"DELETE FROM package_files WHERE package=? AND version=? AND architecture=?",
 			info.Package,
 			info.Version,
+			info.Architecture,
 		); err != nil {
 			return err
 		}
-		stmt3, err := tx.Prepare("INSERT INTO package_files VALUES(?,?,?,?,?,?,?,?,?)")
+		stmt3, err := tx.Prepare("INSERT INTO package_files (package, version, architecture, path, " +
+			"name, size, type, mode, uid, gid) VALUES(?,?,?,?,?,?,?,?,?,?)")
 		if err != nil {
 			return err
 		}
@@ -176,6 +618,7 @@ func dbInsert(info *PackageInfo) error {
 			_, err := stmt3.Exec(
 				info.Package,
 				info.Version,
+				info.Architecture,
 				file.Path,
 				file.Name,
 				file.Size,
@@ -188,11 +631,298 @@ func dbInsert(info *PackageInfo) error {
 				return err
 			}
 		}
+
+		if _, err = tx.Exec(
+			"DELETE FROM elf_objects WHERE package=? AND version=? AND architecture=?",
+			info.Package,
+			info.Version,
+			info.Architecture,
+		); err != nil {
+			return err
+		}
+		stmt4, err := tx.Prepare("INSERT INTO elf_objects (package, version, architecture, path, " +
+			"class, data, type, machine, soname, rpath, runpath, interp, libc, build_id, pie, " +
+			"relro, bind_now, nx_stack, stack_protector, fortify, ibt, shstk, textrel, debug_info, " +
+			"symtab, dynsym, comment, static, toolchain, go_version, provides) VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)")
+		if err != nil {
+			return err
+		}
+		defer stmt4.Close()
+		for _, obj := range info.ELFs {
+			_, err := stmt4.Exec(
+				info.Package,
+				info.Version,
+				info.Architecture,
+				obj.Path,
+				obj.Class,
+				obj.Data,
+				obj.Type,
+				obj.Machine,
+				obj.SoName,
+				strings.Join(obj.RPath, ":"),
+				strings.Join(obj.RunPath, ":"),
+				obj.Interpreter,
+				obj.Libc,
+				obj.BuildID,
+				obj.Hardening.PIE,
+				obj.Hardening.RELRO,
+				obj.Hardening.BindNow,
+				obj.Hardening.NXStack,
+				obj.Hardening.StackProtector,
+				obj.Hardening.Fortify,
+				obj.Hardening.IBT,
+				obj.Hardening.SHSTK,
+				obj.TextRel,
+				obj.DebugInfo,
+				obj.SymTab,
+				obj.DynSym,
+				strings.Join(obj.Comment, "\n"),
+				obj.Static,
+				strings.Join(obj.Toolchain, ","),
+				obj.GoVersion,
+				obj.Provides,
+			)
+			if err != nil {
+				return err
+			}
+		}
+
+		if _, err = tx.Exec(
+			"DELETE FROM elf_needed WHERE package=? AND version=? AND architecture=?",
+			info.Package,
+			info.Version,
+			info.Architecture,
+		); err != nil {
+			return err
+		}
+		stmt5, err := tx.Prepare("INSERT INTO elf_needed (package, version, architecture, path, needed, external) VALUES(?,?,?,?,?,?)")
+		if err != nil {
+			return err
+		}
+		defer stmt5.Close()
+		for _, obj := range info.ELFs {
+			var external = make(map[string]bool, len(obj.Depends))
+			for _, depends := range obj.Depends {
+				external[depends] = true
+			}
+			for _, needed := range obj.Needed {
+				_, err := stmt5.Exec(
+					info.Package,
+					info.Version,
+					info.Architecture,
+					obj.Path,
+					needed,
+					external[needed],
+				)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		if _, err = tx.Exec(
+			"DELETE FROM elf_symbols WHERE package=? AND version=? AND architecture=?",
+			info.Package,
+			info.Version,
+			info.Architecture,
+		); err != nil {
+			return err
+		}
+		stmt6, err := tx.Prepare("INSERT INTO elf_symbols (package, version, architecture, path, " +
+			"symbol, defined, weak) VALUES(?,?,?,?,?,?,?)")
+		if err != nil {
+			return err
+		}
+		defer stmt6.Close()
+		for _, obj := range info.ELFs {
+			for _, symbol := range obj.Symbols {
+				_, err := stmt6.Exec(
+					info.Package,
+					info.Version,
+					info.Architecture,
+					obj.Path,
+					symbol.Name,
+					symbol.Defined,
+					symbol.Weak,
+				)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		if _, err = tx.Exec(
+			"DELETE FROM go_modules WHERE package=? AND version=? AND architecture=?",
+			info.Package,
+			info.Version,
+			info.Architecture,
+		); err != nil {
+			return err
+		}
+		stmt7, err := tx.Prepare("INSERT INTO go_modules (package, version, architecture, path, " +
+			"module, module_version, sum, main, replace_module, replace_version) VALUES(?,?,?,?,?,?,?,?,?,?)")
+		if err != nil {
+			return err
+		}
+		defer stmt7.Close()
+		for _, obj := range info.ELFs {
+			for _, module := range obj.GoModules {
+				_, err := stmt7.Exec(
+					info.Package,
+					info.Version,
+					info.Architecture,
+					obj.Path,
+					module.Path,
+					module.Version,
+					module.Sum,
+					module.Main,
+					module.ReplacePath,
+					module.ReplaceVersion,
+				)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		if _, err = tx.Exec(
+			"DELETE FROM rust_crates WHERE package=? AND version=? AND architecture=?",
+			info.Package,
+			info.Version,
+			info.Architecture,
+		); err != nil {
+			return err
+		}
+		stmt8, err := tx.Prepare("INSERT INTO rust_crates (package, version, architecture, path, " +
+			"crate, crate_version, source, kind, root) VALUES(?,?,?,?,?,?,?,?,?)")
+		if err != nil {
+			return err
+		}
+		defer stmt8.Close()
+		for _, obj := range info.ELFs {
+			for _, crate := range obj.RustCrates {
+				_, err := stmt8.Exec(
+					info.Package,
+					info.Version,
+					info.Architecture,
+					obj.Path,
+					crate.Name,
+					crate.Version,
+					crate.Source,
+					crate.Kind,
+					crate.Root,
+				)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		if _, err = tx.Exec(
+			"DELETE FROM kernel_modinfo WHERE package=? AND version=? AND architecture=?",
+			info.Package,
+			info.Version,
+			info.Architecture,
+		); err != nil {
+			return err
+		}
+		stmt9, err := tx.Prepare("INSERT INTO kernel_modinfo (package, version, architecture, path, key, value) VALUES(?,?,?,?,?,?)")
+		if err != nil {
+			return err
+		}
+		defer stmt9.Close()
+		for _, obj := range info.ELFs {
+			for _, entry := range obj.ModInfo {
+				_, err := stmt9.Exec(
+					info.Package,
+					info.Version,
+					info.Architecture,
+					obj.Path,
+					entry.Key,
+					entry.Value,
+				)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		if err = dbInsertPE(tx, info); err != nil {
+			return err
+		}
+		if err = dbInsertStaticLibraries(tx, info); err != nil {
+			return err
+		}
+
+		if _, err = tx.Exec(
+			"INSERT OR REPLACE INTO hardening_summary (package, version, architecture, objects, "+
+				"executables, pie, relro, bind_now, nx_stack, stack_protector, fortify, ibt, shstk) VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?)",
+			info.Package,
+			info.Version,
+			info.Architecture,
+			info.Hardening.Objects,
+			info.Hardening.Executables,
+			info.Hardening.PIE,
+			info.Hardening.RELRO,
+			info.Hardening.BindNow,
+			info.Hardening.NXStack,
+			info.Hardening.StackProtector,
+			info.Hardening.Fortify,
+			info.Hardening.IBT,
+			info.Hardening.SHSTK,
+		); err != nil {
+			return err
+		}
+
+		for _, set := range []struct {
+			table, column string
+			versions      []ELFVersion
+		}{
+			{"elf_version_depends", "depends", info.VersionDepends},
+			{"elf_version_provides", "provides", info.VersionProvides},
+			{"elf_version_minimum", "depends", info.VersionMinimum},
+		} {
+			if err := dbInsertVersions(tx, set.table, set.column, info, set.versions); err != nil {
+				return err
+			}
+		}
 	}
 	tx.Commit()
 	return nil
 }
 
+// dbInsertVersions writes a table of symbol versions, whose library column
+// is named column.
+func dbInsertVersions(tx *sql.Tx, table, column string, info *PackageInfo, versions []ELFVersion) error {
+	if _, err := tx.Exec(
+		"DELETE FROM "+table+" WHERE package=? AND version=? AND architecture=?",
+		info.Package,
+		info.Version,
+		info.Architecture,
+	); err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare("INSERT INTO " + table + " (package, version, architecture, " + column + ", sover, symver) VALUES(?,?,?,?,?,?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, version := range versions {
+		name, sover := SplitSoName(version.SoName)
+		if _, err := stmt.Exec(
+			info.Package,
+			info.Version,
+			info.Architecture,
+			name,
+			sover,
+			version.Version,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func SplitSoName(soname string) (name, sover string) {
 	a := strings.LastIndex(soname, ".so")
 	if a == -1 {
@@ -201,3 +931,410 @@ func SplitSoName(soname string) (name, sover string) {
 		return soname[:a+3], soname[a+3:]
 	}
 }
+
+// dbInsertPE writes the PE files of a package, and the package level
+// pe_provides and pe_depends derived from them.
+func dbInsertPE(tx *sql.Tx, info *PackageInfo) error {
+	for _, table := range []string{"pe_provides", "pe_depends", "pe_objects", "pe_imports", "pe_exports"} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE package=? AND version=? AND architecture=?", info.Package, info.Version, info.Architecture); err != nil {
+			return err
+		}
+	}
+	for table, dlls := range map[string][]string{
+		"pe_provides": info.PEProvides,
+		"pe_depends":  info.PEDepends,
+	} {
+		for _, dll := range dlls {
+			column := strings.TrimPrefix(table, "pe_")
+			if _, err := tx.Exec("INSERT INTO "+table+" (package, version, architecture, "+column+") VALUES(?,?,?,?)", info.Package, info.Version, info.Architecture, dll); err != nil {
+				return err
+			}
+		}
+	}
+	for _, obj := range info.PEs {
+		if _, err := tx.Exec(
+			"INSERT INTO pe_objects (package, version, architecture, path, machine, dll, name) VALUES(?,?,?,?,?,?,?)",
+			info.Package,
+			info.Version,
+			info.Architecture,
+			obj.Path,
+			obj.Machine,
+			obj.DLL,
+			obj.Name,
+		); err != nil {
+			return err
+		}
+		var external = make(map[string]bool, len(obj.Depends))
+		for _, dll := range obj.Depends {
+			external[dll] = true
+		}
+		for _, dll := range obj.Imports {
+			if _, err := tx.Exec(
+				"INSERT INTO pe_imports (package, version, architecture, path, dll, external) VALUES(?,?,?,?,?,?)",
+				info.Package,
+				info.Version,
+				info.Architecture,
+				obj.Path,
+				dll,
+				external[dll],
+			); err != nil {
+				return err
+			}
+		}
+		for _, symbol := range obj.Exports {
+			if _, err := tx.Exec(
+				"INSERT INTO pe_exports (package, version, architecture, path, symbol) VALUES(?,?,?,?,?)",
+				info.Package,
+				info.Version,
+				info.Architecture,
+				obj.Path,
+				symbol,
+			); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// dbInsertStaticLibraries writes the members of the static libraries of a
+// package and the symbols they define.
+func dbInsertStaticLibraries(tx *sql.Tx, info *PackageInfo) error {
+	for _, table := range []string{"static_members", "static_symbols"} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE package=? AND version=? AND architecture=?", info.Package, info.Version, info.Architecture); err != nil {
+			return err
+		}
+	}
+	stmtMember, err := tx.Prepare("INSERT INTO static_members (package, version, architecture, path, member, machine) VALUES(?,?,?,?,?,?)")
+	if err != nil {
+		return err
+	}
+	defer stmtMember.Close()
+	stmtSymbol, err := tx.Prepare("INSERT INTO static_symbols (package, version, architecture, " +
+		"path, member, symbol, weak) VALUES(?,?,?,?,?,?,?)")
+	if err != nil {
+		return err
+	}
+	defer stmtSymbol.Close()
+	for _, archive := range info.Archives {
+		for _, member := range archive.Members {
+			if _, err := stmtMember.Exec(
+				info.Package,
+				info.Version,
+				info.Architecture,
+				archive.Path,
+				member.Name,
+				member.Machine,
+			); err != nil {
+				return err
+			}
+			for _, symbol := range member.Symbols {
+				if _, err := stmtSymbol.Exec(
+					info.Package,
+					info.Version,
+					info.Architecture,
+					archive.Path,
+					member.Name,
+					symbol.Name,
+					symbol.Weak,
+				); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// ELFObjectKey identifies an ELF object in the repository.
+type ELFObjectKey struct {
+	Package      string
+	Version      string
+	Architecture string
+	Path         string
+}
+
+// Finding is a problem found by a repository wide check.
+type Finding struct {
+	ELFObjectKey
+	Kind    string
+	Subject string
+	Detail  string
+}
+
+// dbELFObjects loads every ELF object of the repository with its NEEDED list.
+func dbELFObjects() (map[ELFObjectKey]*ELFSOInfo, error) {
+	var objects = make(map[ELFObjectKey]*ELFSOInfo)
+	rows, err := DB.Query("SELECT package, version, architecture, path, class, data, type, machine, soname, interp, dynsym FROM elf_objects")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key ELFObjectKey
+		var obj ELFSOInfo
+		if err := rows.Scan(&key.Package, &key.Version, &key.Architecture, &key.Path, &obj.Class, &obj.Data, &obj.Type, &obj.Machine, &obj.SoName, &obj.Interpreter, &obj.DynSym); err != nil {
+			return nil, err
+		}
+		obj.Path = key.Path
+		objects[key] = &obj
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = DB.Query("SELECT package, version, architecture, path, needed FROM elf_needed")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key ELFObjectKey
+		var needed string
+		if err := rows.Scan(&key.Package, &key.Version, &key.Architecture, &key.Path, &needed); err != nil {
+			return nil, err
+		}
+		if obj, exist := objects[key]; exist {
+			obj.Needed = append(obj.Needed, needed)
+		}
+	}
+	return objects, rows.Err()
+}
+
+func dbELFSymbols(key ELFObjectKey, defined bool) ([]ELFSymbol, error) {
+	rows, err := DB.Query(
+		"SELECT symbol, weak FROM elf_symbols WHERE package=? AND version=? AND architecture=? AND path=? AND defined=?",
+		key.Package,
+		key.Version,
+		key.Architecture,
+		key.Path,
+		defined,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var symbols []ELFSymbol
+	for rows.Next() {
+		var symbol = ELFSymbol{Defined: defined}
+		if err := rows.Scan(&symbol.Name, &symbol.Weak); err != nil {
+			return nil, err
+		}
+		symbols = append(symbols, symbol)
+	}
+	return symbols, rows.Err()
+}
+
+// dbInterpreters lists the requested dynamic linkers of all ELF objects.
+func dbInterpreters() (map[ELFObjectKey]*ELFSOInfo, error) {
+	rows, err := DB.Query("SELECT package, version, architecture, path, interp, libc FROM elf_objects WHERE interp != ''")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var objects = make(map[ELFObjectKey]*ELFSOInfo)
+	for rows.Next() {
+		var key ELFObjectKey
+		var obj ELFSOInfo
+		if err := rows.Scan(&key.Package, &key.Version, &key.Architecture, &key.Path, &obj.Interpreter, &obj.Libc); err != nil {
+			return nil, err
+		}
+		obj.Path = key.Path
+		objects[key] = &obj
+	}
+	return objects, rows.Err()
+}
+
+// dbArchitectures lists the ELF objects of every package. Their keys carry
+// the Architecture field of the package.
+func dbArchitectures() (map[ELFObjectKey]*ELFSOInfo, error) {
+	rows, err := DB.Query("SELECT package, version, architecture, path, class, data, machine FROM elf_objects")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var objects = make(map[ELFObjectKey]*ELFSOInfo)
+	for rows.Next() {
+		var key ELFObjectKey
+		var obj ELFSOInfo
+		if err := rows.Scan(&key.Package, &key.Version, &key.Architecture, &key.Path, &obj.Class, &obj.Data, &obj.Machine); err != nil {
+			return nil, err
+		}
+		obj.Path = key.Path
+		objects[key] = &obj
+	}
+	return objects, rows.Err()
+}
+
+// ModInfoEntry is a .modinfo entry of a kernel module in the repository.
+type ModInfoEntry struct {
+	ELFObjectKey
+	ModInfo
+}
+
+// dbModInfo lists the .modinfo entries with the given key of all modules.
+func dbModInfo(key string) ([]ModInfoEntry, error) {
+	rows, err := DB.Query("SELECT package, version, architecture, path, key, value FROM kernel_modinfo WHERE key=?", key)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []ModInfoEntry
+	for rows.Next() {
+		var entry ModInfoEntry
+		if err := rows.Scan(&entry.Package, &entry.Version, &entry.Architecture, &entry.Path, &entry.Key, &entry.Value); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// dbFileShipped reports whether some package ships the file, given as an
+// absolute path.
+func dbFileShipped(file string) (bool, error) {
+	dir, name := path.Split(file)
+	rows, err := DB.Query("SELECT 1 FROM package_files WHERE path=? AND name=? LIMIT 1", "."+dir, name)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	return rows.Next(), rows.Err()
+}
+
+// dbBuildIDs lists the build-ids of all executables and shared objects,
+// separate debug files under /usr/lib/debug excluded.
+func dbBuildIDs() (map[ELFObjectKey]string, error) {
+	rows, err := DB.Query(
+		"SELECT package, version, architecture, path, build_id FROM elf_objects WHERE build_id != '' AND path NOT LIKE './usr/lib/debug/%' AND type IN (?, ?)",
+		int(elf.ET_EXEC),
+		int(elf.ET_DYN),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var buildIDs = make(map[ELFObjectKey]string)
+	for rows.Next() {
+		var key ELFObjectKey
+		var buildID string
+		if err := rows.Scan(&key.Package, &key.Version, &key.Architecture, &key.Path, &buildID); err != nil {
+			return nil, err
+		}
+		buildIDs[key] = buildID
+	}
+	return buildIDs, rows.Err()
+}
+
+// dbDebugFiles lists the files shipped under /usr/lib/debug/.build-id/.
+func dbDebugFiles() ([]ELFObjectKey, error) {
+	rows, err := DB.Query("SELECT package, version, architecture, path, name FROM package_files WHERE path LIKE './usr/lib/debug/.build-id/%' AND name LIKE '%.debug'")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var files []ELFObjectKey
+	for rows.Next() {
+		var key ELFObjectKey
+		var name string
+		if err := rows.Scan(&key.Package, &key.Version, &key.Architecture, &key.Path, &name); err != nil {
+			return nil, err
+		}
+		key.Path += name
+		files = append(files, key)
+	}
+	return files, rows.Err()
+}
+
+// dbReplaceDebugIndex rebuilds the debug_index table.
+func dbReplaceDebugIndex(buildIDs map[ELFObjectKey]string, debugFiles map[string]ELFObjectKey) error {
+	lockWrite.Lock()
+	defer lockWrite.Unlock()
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM debug_index"); err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare("INSERT INTO debug_index (build_id, package, version, architecture, " +
+		"path, debug_package, debug_version, debug_architecture, debug_path) VALUES(?,?,?,?,?,?,?,?,?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for key, buildID := range buildIDs {
+		debug := debugFiles[buildID]
+		if _, err := stmt.Exec(
+			buildID,
+			key.Package,
+			key.Version,
+			key.Architecture,
+			key.Path,
+			debug.Package,
+			debug.Version,
+			debug.Architecture,
+			debug.Path,
+		); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// dbInsertFailure records why a package could not be scanned. The row is
+// removed again once a later scan of the same file succeeds.
+func dbInsertFailure(filename string, mtime int64, info *PackageInfo, stage string, failure error) error {
+	lockWrite.Lock()
+	defer lockWrite.Unlock()
+	var pkg, version string
+	if info != nil {
+		pkg, version = info.Package, info.Version
+	}
+	_, err := DB.Exec(
+		"INSERT OR REPLACE INTO scan_failures (filename, mtime, package, version, stage, error) VALUES(?,?,?,?,?,?)",
+		filename,
+		mtime,
+		pkg,
+		version,
+		stage,
+		failure.Error(),
+	)
+	return err
+}
+
+// dbReplaceFindings replaces all findings of the given kinds.
+func dbReplaceFindings(kinds []string, findings []Finding) error {
+	lockWrite.Lock()
+	defer lockWrite.Unlock()
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, kind := range kinds {
+		if _, err := tx.Exec("DELETE FROM findings WHERE kind=?", kind); err != nil {
+			return err
+		}
+	}
+	stmt, err := tx.Prepare("INSERT INTO findings (package, version, architecture, path, kind, subject, detail) VALUES(?,?,?,?,?,?,?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, finding := range findings {
+		if _, err := stmt.Exec(
+			finding.Package,
+			finding.Version,
+			finding.Architecture,
+			finding.Path,
+			finding.Kind,
+			finding.Subject,
+			finding.Detail,
+		); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io"
+	"path"
+	"strings"
+)
+
+// StaticLibrary lists the members of a lib*.a archive.
+type StaticLibrary struct {
+	Path    string
+	Members []*StaticLibraryMember
+}
+
+// StaticLibraryMember is an object of a static library, with the symbols it
+// defines. Members which are not ELF objects, such as LTO bitcode, have no
+// symbols.
+type StaticLibraryMember struct {
+	Name    string
+	Machine int
+	Symbols []ELFSymbol
+}
+
+// IsStaticLibrary tells static libraries by their file names.
+func IsStaticLibrary(file string) bool {
+	var name = path.Base(file)
+	return strings.HasPrefix(name, "lib") && strings.HasSuffix(name, ".a")
+}
+
+// analyseStaticLibrary parses the ELF symbol table of every member of the
+// archive. Members are read one by one, so only one of them is buffered.
+func analyseStaticLibrary(input io.Reader, info *StaticLibrary) error {
+	return ArWalk(input, func(fd *ArFileDescriptor, member io.Reader) {
+		var memberInfo = StaticLibraryMember{Name: fd.Name}
+		var soInfo = ELFSOInfo{Path: fd.Name}
+		if err := analyseArchiveMember(member, fd.Size, &soInfo); err == nil {
+			memberInfo.Machine = soInfo.Machine
+			memberInfo.Symbols = DefinedSymbols(soInfo.Symbols)
+		}
+		info.Members = append(info.Members, &memberInfo)
+	})
+}
@@ -19,3 +19,87 @@ func (m *meterFilter) Read(b []byte) (int, error) {
 	atomic.AddInt64(m.meter, int64(n))
 	return n, err
 }
+
+const (
+	readAheadBlockSize = 1024 * 1024
+	readAheadBlocks    = 8
+)
+
+type readAheadBlock struct {
+	data []byte
+	err  error
+}
+
+// readAhead reads its input in a goroutine, up to readAheadBlocks blocks
+// ahead of the consumer. Errors of the input are returned in order, once
+// the data read before them has been consumed.
+type readAhead struct {
+	r       io.ReadCloser
+	blocks  chan readAheadBlock
+	done    chan struct{}
+	current readAheadBlock
+}
+
+func NewReadAhead(r io.ReadCloser) io.ReadCloser {
+	var ra = &readAhead{
+		r:      r,
+		blocks: make(chan readAheadBlock, readAheadBlocks),
+		done:   make(chan struct{}),
+	}
+	go ra.fill()
+	return ra
+}
+
+func (ra *readAhead) fill() {
+	defer close(ra.blocks)
+	for {
+		select {
+		case <-ra.done:
+			return
+		default:
+		}
+		// Not io.ReadFull, which would take an io.ErrUnexpectedEOF of the
+		// decoder for the end of the stream
+		var buf = make([]byte, readAheadBlockSize)
+		var n int
+		var err error
+		for n != len(buf) && err == nil {
+			var m int
+			m, err = ra.r.Read(buf[n:])
+			n += m
+		}
+		select {
+		case ra.blocks <- readAheadBlock{data: buf[:n], err: err}:
+		case <-ra.done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (ra *readAhead) Read(b []byte) (int, error) {
+	for len(ra.current.data) == 0 {
+		if ra.current.err != nil {
+			return 0, ra.current.err
+		}
+		block, ok := <-ra.blocks
+		if !ok {
+			return 0, io.ErrClosedPipe
+		}
+		ra.current = block
+	}
+	n := copy(b, ra.current.data)
+	ra.current.data = ra.current.data[n:]
+	return n, nil
+}
+
+// Close stops the goroutine, which must not read the input any more once
+// the caller moves on to the rest of the stream.
+func (ra *readAhead) Close() error {
+	close(ra.done)
+	for range ra.blocks { // wait for the goroutine to leave
+	}
+	return ra.r.Close()
+}
@@ -13,16 +13,34 @@ var (
 	ErrSeekWhence = errors.New("UDFR: invalid argument")
 )
 
+// UDFR turns a forward-only stream into a seekable reader by keeping every
+// block it has read from the stream. Seeking forward reads (and keeps) the
+// data in between, seeking backward is served from the kept blocks.
 type UDFR struct {
 	i      io.Reader
 	buffer map[int64][]byte
 	cur    int64
 	edge   int64
 	eof    bool
+	size   int64 // of the stream, or -1 if unknown
 }
 
 func NewUDFR(input io.Reader) *UDFR {
-	return &UDFR{i: input, buffer: make(map[int64][]byte), edge: 0}
+	return NewSizedUDFR(input, -1)
+}
+
+// NewSizedUDFR is NewUDFR for a stream of known size, such as a tar entry.
+func NewSizedUDFR(input io.Reader, size int64) *UDFR {
+	return &UDFR{i: input, buffer: make(map[int64][]byte), edge: 0, size: size}
+}
+
+// Contains reports whether the range lies within the stream, as far as its
+// size is known.
+func (r *UDFR) Contains(offset, size uint64) bool {
+	if r.size < 0 {
+		return true
+	}
+	return offset <= uint64(r.size) && size <= uint64(r.size)-offset
 }
 
 func (r *UDFR) Read(b []byte) (int, error) {
@@ -30,84 +48,76 @@ func (r *UDFR) Read(b []byte) (int, error) {
 		return 0, io.EOF
 	}
 	var i int
-	for i = 0; i != len(b); i++ {
-		c, err := r.readByte(true)
-		if err == io.EOF {
-			return i, nil
+	for i != len(b) {
+		if r.cur == r.edge {
+			err := r.fill()
+			if err == io.EOF {
+				return i, nil
+			}
+			if err != nil {
+				return i, err
+			}
+			continue
+		}
+		// Reading in buffer
+		frame, framePresent := r.buffer[r.cur/FileReaderBlockSize]
+		if !framePresent {
+			return i, ErrLookBack
 		}
-		if err != nil {
-			return i, err
+		frameOffset := r.cur % FileReaderBlockSize
+		frameEnd := int64(len(frame))
+		if r.edge-r.cur < frameEnd-frameOffset {
+			frameEnd = frameOffset + r.edge - r.cur
 		}
-		b[i] = c
+		n := copy(b[i:], frame[frameOffset:frameEnd])
+		i += n
+		r.cur += int64(n)
 	}
 	return i, nil
 }
 
-func (r *UDFR) readByte(buffer bool) (byte, error) {
-	if r.cur == r.edge && r.eof {
-		return 0, io.EOF
+// fill reads more data from the stream into the frame on the edge.
+func (r *UDFR) fill() error {
+	if r.eof {
+		return io.EOF
 	}
-	frameIndex := r.cur / FileReaderBlockSize
-	frameOffset := r.cur % FileReaderBlockSize
+	frameIndex := r.edge / FileReaderBlockSize
+	frameOffset := r.edge % FileReaderBlockSize
 	frame, framePresent := r.buffer[frameIndex]
-
-	var data byte
-	var err error
-	if r.cur == r.edge {
-		// Reading on the edge
-		if !framePresent {
-			frame = make([]byte, FileReaderBlockSize)
-			r.buffer[frameIndex] = frame
-		}
-		var preRead int
-		preRead, err = r.i.Read(frame[frameOffset:])
-		if err == io.EOF {
-			r.eof = true
-			return 0, io.EOF
-		}
-		if err == nil {
-			r.cur++
-			r.edge += int64(preRead)
-			data = frame[frameOffset]
-		}
-	} else {
-		// Reading in buffer
-		if !framePresent {
-			return 0, ErrLookBack
+	if !framePresent {
+		frame = make([]byte, FileReaderBlockSize)
+		r.buffer[frameIndex] = frame
+	}
+	n, err := r.i.Read(frame[frameOffset:])
+	r.edge += int64(n)
+	if err == io.EOF {
+		r.eof = true
+		if n == 0 {
+			return io.EOF
 		}
-		data = frame[frameOffset]
-		r.cur++
+		return nil
 	}
-	return data, err
+	return err
 }
 
-func (r *UDFR) Seek(offset int64, whence int, buffer bool) (int64, error) {
+func (r *UDFR) Seek(offset int64, whence int) (int64, error) {
 	switch whence {
 	case io.SeekStart:
-		return r.Seek(offset-r.cur, io.SeekCurrent, buffer)
+		return r.Seek(offset-r.cur, io.SeekCurrent)
 	case io.SeekEnd:
 		return 0, ErrSeekEnd
 	case io.SeekCurrent:
-		if offset <= 0 {
-			r.cur += offset
-			return r.cur, nil
-		}
-		if r.cur+offset <= r.edge {
-			r.cur += offset
-			return r.cur, nil
-		}
 		newCur := r.cur + offset
-		if buffer {
-			for r.cur < newCur {
-				_, err := r.readByte(buffer)
-				if err != nil {
-					return r.cur, err
-				}
+		if newCur < 0 {
+			return r.cur, ErrSeekWhence
+		}
+		for r.edge < newCur {
+			if err := r.fill(); err != nil {
+				r.cur = r.edge
+				return r.cur, err
 			}
-		} else {
-			r.cur = newCur
-			return r.cur, nil
 		}
+		r.cur = newCur
 		return r.cur, nil
 	default:
 		return 0, ErrSeekWhence
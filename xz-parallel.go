@@ -0,0 +1,592 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"hash/crc64"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/ulikunitz/xz"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+// Layout of the xz container, see the .xz file format specification.
+const (
+	xzStreamHeaderSize   = 12
+	xzStreamFooterSize   = 12
+	xzBlockHasCompSize   = 0x40
+	xzBlockHasUncompSize = 0x80
+	xzBlockReserved      = 0x3c
+	xzFilterLZMA2        = 0x21
+	xzMaxBlockSize       = 256 * 1024 * 1024
+)
+
+// Integrity checks, the low nibble of the stream flags
+const (
+	xzCheckNone   = 0x00
+	xzCheckCRC32  = 0x01
+	xzCheckCRC64  = 0x04
+	xzCheckSHA256 = 0x0a
+)
+
+var xzStreamMagic = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+
+var (
+	ErrXzBlock = errors.New("xz: unsupported or corrupt block header")
+	ErrXzCheck = errors.New("xz: block does not match its check or header")
+	ErrXzIndex = errors.New("xz: index or footer does not match the blocks")
+)
+
+// XzParallelBudget caps the decoded bytes a parallel xz stream holds at once,
+// in the decoders running and in the blocks the reader has not consumed yet.
+// A block larger than that is still decoded, but alone.
+var XzParallelBudget int64 = 128 * 1024 * 1024
+
+// xzBlock is a block of the stream, first wrapped into a stream of its own
+// and then decoded. Blocks without sizes are decoded by the reader itself
+// instead, through serial.
+type xzBlock struct {
+	stream []byte
+	record xzRecord
+	data   []byte
+	err    error
+	done   chan struct{}
+
+	serial   *xzSerialBlock
+	consumed chan struct{} // closed once the reader is through serial
+}
+
+// xzRecord is the index record of a block.
+type xzRecord struct {
+	unpaddedSize     uint64
+	uncompressedSize uint64
+}
+
+// xzParallel decodes the blocks of a stream written by xz -T concurrently.
+// Such streams record the compressed and uncompressed size in every block
+// header, which lets a block be cut out of the stream and decoded alone.
+// The blocks are handed to the reader in stream order. A block without the
+// sizes can only be delimited by decoding it, which the reader does while
+// the splitting waits.
+type xzParallel struct {
+	input     *bufio.Reader
+	header    []byte
+	checkSize int
+	order     chan *xzBlock
+	workers   chan struct{}
+	stop      chan struct{}
+	current   *xzBlock
+	err       error
+
+	// Decoded bytes in flight, see XzParallelBudget
+	lock     sync.Mutex
+	budget   *sync.Cond
+	inflight int64
+	stopped  bool
+}
+
+// ParallelXzDecompress decodes up to workers blocks at once, as long as
+// XzParallelBudget allows. Streams whose first block header carries no
+// sizes, as single-threaded xz writes them, are decoded serially ahead of
+// the reader instead.
+func ParallelXzDecompress(input io.Reader, workers int) (io.ReadCloser, error) {
+	// Stream header, then the size and the flags of the first block header
+	var head = make([]byte, xzStreamHeaderSize+2)
+	n, _ := io.ReadFull(input, head)
+	var rest = io.MultiReader(bytes.NewReader(head[:n]), input)
+	if n < len(head) || !bytes.HasPrefix(head, xzStreamMagic) {
+		return XzDecompress(rest) // reports what is wrong with it
+	}
+	var flags = head[xzStreamHeaderSize+1]
+	if head[xzStreamHeaderSize] == 0 || flags&xzBlockHasCompSize == 0 || flags&xzBlockHasUncompSize == 0 {
+		reader, err := XzDecompress(rest)
+		if err != nil {
+			return nil, err
+		}
+		return NewReadAhead(reader), nil
+	}
+
+	var r = &xzParallel{
+		input:     bufio.NewReader(io.MultiReader(bytes.NewReader(head[xzStreamHeaderSize:]), input)),
+		header:    head[:xzStreamHeaderSize],
+		checkSize: xzCheckSize(head[7]),
+		order:     make(chan *xzBlock, workers),
+		workers:   make(chan struct{}, workers),
+		stop:      make(chan struct{}),
+	}
+	r.budget = sync.NewCond(&r.lock)
+	go r.split()
+	return r, nil
+}
+
+// split cuts the stream into blocks and starts a decoder for each of them,
+// until the index of the stream is reached. The decoders of the single
+// blocks check the sizes and the integrity of what they decode, the index
+// and the footer are checked against the blocks. dpkg-deb writes a single
+// stream, so nothing is expected after it.
+func (r *xzParallel) split() {
+	defer close(r.order)
+	var records []xzRecord
+	for {
+		var sizeByte [1]byte
+		if _, err := io.ReadFull(r.input, sizeByte[:]); err != nil {
+			r.send(&xzBlock{err: io.ErrUnexpectedEOF})
+			return
+		}
+		if sizeByte[0] == 0 { // index indicator
+			if err := r.readIndex(records); err != nil {
+				r.send(&xzBlock{err: err})
+				return
+			}
+			io.Copy(ioutil.Discard, r.input)
+			return
+		}
+
+		blockHeader, err := r.readBlockHeader(sizeByte[0])
+		if err != nil {
+			r.send(&xzBlock{err: err})
+			return
+		}
+		if blockHeader[1]&xzBlockHasCompSize == 0 || blockHeader[1]&xzBlockHasUncompSize == 0 {
+			var block = &xzBlock{consumed: make(chan struct{})}
+			block.serial, block.err = r.serialBlock(blockHeader)
+			if !r.send(block) || block.err != nil {
+				return
+			}
+			select {
+			case <-block.consumed:
+			case <-r.stop:
+				return
+			}
+			records = append(records, block.serial.record)
+			continue
+		}
+
+		var block = &xzBlock{done: make(chan struct{})}
+		block.stream, block.record, block.err = r.readBlock(blockHeader)
+		if block.err == io.EOF {
+			block.err = io.ErrUnexpectedEOF
+		}
+		if block.err != nil {
+			close(block.done)
+			r.send(block)
+			return
+		}
+		records = append(records, block.record)
+		if !r.acquire(int64(block.record.uncompressedSize)) {
+			return
+		}
+		select {
+		case r.workers <- struct{}{}:
+		case <-r.stop:
+			return
+		}
+		if !r.send(block) {
+			<-r.workers
+			return
+		}
+		go func() {
+			defer func() { <-r.workers }()
+			defer close(block.done)
+			reader, err := xz.NewReader(bytes.NewReader(block.stream))
+			block.stream = nil
+			if err != nil {
+				block.err = err
+				return
+			}
+			block.data, block.err = ioutil.ReadAll(reader)
+		}()
+	}
+}
+
+// send queues the block for the reader, unless the reader was closed.
+func (r *xzParallel) send(block *xzBlock) bool {
+	if block.done == nil {
+		block.done = make(chan struct{})
+		close(block.done)
+	}
+	select {
+	case r.order <- block:
+		return true
+	case <-r.stop:
+		return false
+	}
+}
+
+// acquire waits until the budget has room for size more decoded bytes, or
+// nothing else is in flight. It fails once the reader is closed.
+func (r *xzParallel) acquire(size int64) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for !r.stopped && r.inflight != 0 && r.inflight+size > XzParallelBudget {
+		r.budget.Wait()
+	}
+	if r.stopped {
+		return false
+	}
+	r.inflight += size
+	return true
+}
+
+// release returns the bytes of a block the reader has consumed.
+func (r *xzParallel) release(size int64) {
+	r.lock.Lock()
+	r.inflight -= size
+	r.lock.Unlock()
+	r.budget.Signal()
+}
+
+// readBlockHeader reads the block header which begins with sizeByte.
+func (r *xzParallel) readBlockHeader(sizeByte byte) ([]byte, error) {
+	var blockHeader = make([]byte, (int(sizeByte)+1)*4)
+	blockHeader[0] = sizeByte
+	if _, err := io.ReadFull(r.input, blockHeader[1:]); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return blockHeader, nil
+}
+
+// readBlock reads the block after blockHeader, which carries both sizes,
+// and wraps it into a stream of its own: the original stream header, the
+// block, an index of one record and a stream footer. It returns the index
+// record of the block as well.
+func (r *xzParallel) readBlock(blockHeader []byte) ([]byte, xzRecord, error) {
+	var headerSize = len(blockHeader)
+	compressedSize, n := binary.Uvarint(blockHeader[2:])
+	if n <= 0 {
+		return nil, xzRecord{}, ErrXzBlock
+	}
+	uncompressedSize, m := binary.Uvarint(blockHeader[2+n:])
+	if m <= 0 || compressedSize > xzMaxBlockSize || uncompressedSize > xzMaxBlockSize {
+		return nil, xzRecord{}, ErrXzBlock
+	}
+
+	var paddedSize = int64(compressedSize+3) &^ 3
+	var unpaddedSize = uint64(headerSize) + compressedSize + uint64(r.checkSize)
+	var stream = bytes.NewBuffer(make([]byte, 0, xzStreamHeaderSize+int(unpaddedSize)+3+32+xzStreamFooterSize))
+	stream.Write(r.header)
+	stream.Write(blockHeader)
+	if _, err := io.CopyN(stream, r.input, paddedSize+int64(r.checkSize)); err != nil {
+		return nil, xzRecord{}, err
+	}
+
+	// Index: indicator, number of records, the record, padding and CRC32
+	var index = make([]byte, 1, 32)
+	var varint [binary.MaxVarintLen64]byte
+	for _, value := range []uint64{1, unpaddedSize, uncompressedSize} {
+		index = append(index, varint[:binary.PutUvarint(varint[:], value)]...)
+	}
+	for len(index)%4 != 0 {
+		index = append(index, 0)
+	}
+	var crc [4]byte
+	binary.LittleEndian.PutUint32(crc[:], crc32.ChecksumIEEE(index))
+	index = append(index, crc[:]...)
+	stream.Write(index)
+
+	// Footer: CRC32, backward size, stream flags and magic
+	var footer = make([]byte, xzStreamFooterSize)
+	binary.LittleEndian.PutUint32(footer[4:], uint32(len(index)/4-1))
+	copy(footer[8:], r.header[6:8])
+	copy(footer[10:], "YZ")
+	binary.LittleEndian.PutUint32(footer, crc32.ChecksumIEEE(footer[4:10]))
+	stream.Write(footer)
+	return stream.Bytes(), xzRecord{unpaddedSize, uncompressedSize}, nil
+}
+
+// xzSerialBlock decodes a block whose header lacks the compressed or the
+// uncompressed size, straight from the input of the stream. It checks the
+// sizes the header has, the padding and the integrity check at the end.
+type xzSerialBlock struct {
+	input        *xzCountingReader
+	lzma2        *lzma.Reader2
+	check        hash.Hash
+	checkType    byte
+	headerSize   uint64
+	flags        byte   // of the block header, telling the sizes present
+	compressed   uint64 // from the header, if present
+	uncompressed uint64 // likewise
+	record       xzRecord
+}
+
+// serialBlock prepares the decoding of the block after blockHeader. Only
+// the LZMA2 filter is supported, as by the xz package itself.
+func (r *xzParallel) serialBlock(blockHeader []byte) (*xzSerialBlock, error) {
+	var size = len(blockHeader)
+	if binary.LittleEndian.Uint32(blockHeader[size-4:]) != crc32.ChecksumIEEE(blockHeader[:size-4]) {
+		return nil, ErrXzBlock
+	}
+	var flags = blockHeader[1]
+	if flags&xzBlockReserved != 0 || flags&0x03 != 0 { // one filter only
+		return nil, ErrXzBlock
+	}
+	var block = &xzSerialBlock{headerSize: uint64(size), flags: flags, checkType: r.header[7] & 0x0f}
+	var fields = blockHeader[2 : size-4]
+	var valid = true
+	varint := func() uint64 {
+		value, n := binary.Uvarint(fields)
+		if n <= 0 {
+			valid = false
+			return 0
+		}
+		fields = fields[n:]
+		return value
+	}
+	if flags&xzBlockHasCompSize != 0 {
+		block.compressed = varint()
+	}
+	if flags&xzBlockHasUncompSize != 0 {
+		block.uncompressed = varint()
+	}
+	// Filter ID and the size of its properties, then the dictionary size
+	var filter, properties = varint(), varint()
+	if !valid || filter != xzFilterLZMA2 || properties != 1 || len(fields) < 1 {
+		return nil, ErrXzBlock
+	}
+	var dictCap, err = xzDictCap(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	for _, padding := range fields[1:] {
+		if padding != 0 {
+			return nil, ErrXzBlock
+		}
+	}
+
+	switch block.checkType {
+	case xzCheckNone:
+	case xzCheckCRC32:
+		block.check = crc32.NewIEEE()
+	case xzCheckCRC64:
+		block.check = crc64.New(crc64.MakeTable(crc64.ECMA))
+	case xzCheckSHA256:
+		block.check = sha256.New()
+	default:
+		return nil, ErrXzBlock
+	}
+	block.input = &xzCountingReader{input: r.input}
+	block.lzma2, err = lzma.Reader2Config{DictCap: dictCap}.NewReader2(block.input)
+	if err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+func (b *xzSerialBlock) Read(p []byte) (int, error) {
+	n, err := b.lzma2.Read(p)
+	if b.check != nil {
+		b.check.Write(p[:n])
+	}
+	b.record.uncompressedSize += uint64(n)
+	if err == io.EOF {
+		if err := b.finish(); err != nil {
+			return n, err
+		}
+	} else if err == nil && b.flags&xzBlockHasUncompSize != 0 && b.record.uncompressedSize > b.uncompressed {
+		err = ErrXzCheck
+	}
+	return n, err
+}
+
+// finish reads and checks the padding and the check after the compressed
+// data, and completes the index record.
+func (b *xzSerialBlock) finish() error {
+	var compressed = uint64(b.input.n)
+	if b.flags&xzBlockHasCompSize != 0 && compressed != b.compressed ||
+		b.flags&xzBlockHasUncompSize != 0 && b.record.uncompressedSize != b.uncompressed {
+		return ErrXzCheck
+	}
+	var tail = make([]byte, (4-compressed%4)%4+uint64(xzCheckSize(b.checkType)))
+	if _, err := io.ReadFull(b.input.input, tail); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	var padding = len(tail) - xzCheckSize(b.checkType)
+	for _, zero := range tail[:padding] {
+		if zero != 0 {
+			return ErrXzCheck
+		}
+	}
+	var check = tail[padding:]
+	switch b.checkType {
+	case xzCheckCRC32:
+		if binary.LittleEndian.Uint32(check) != b.check.(hash.Hash32).Sum32() {
+			return ErrXzCheck
+		}
+	case xzCheckCRC64:
+		if binary.LittleEndian.Uint64(check) != b.check.(hash.Hash64).Sum64() {
+			return ErrXzCheck
+		}
+	case xzCheckSHA256:
+		if !bytes.Equal(check, b.check.Sum(nil)) {
+			return ErrXzCheck
+		}
+	}
+	b.record.unpaddedSize = b.headerSize + compressed + uint64(len(check))
+	return nil
+}
+
+// xzDictCap decodes the dictionary size property of LZMA2.
+func xzDictCap(property byte) (int, error) {
+	if property > 40 {
+		return 0, ErrXzBlock
+	}
+	var dictCap = int64(2|property&1) << (property/2 + 11)
+	if property == 40 || dictCap > xzMaxBlockSize {
+		return 0, ErrXzBlock // larger than the blocks accepted
+	}
+	if dictCap < lzma.MinDictCap {
+		dictCap = lzma.MinDictCap
+	}
+	return int(dictCap), nil
+}
+
+// xzCountingReader counts the bytes read through it.
+type xzCountingReader struct {
+	input io.Reader
+	n     int64
+}
+
+func (r *xzCountingReader) Read(p []byte) (int, error) {
+	n, err := r.input.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// readIndex reads the index after its indicator and the stream footer, and
+// checks them against the blocks read.
+func (r *xzParallel) readIndex(records []xzRecord) error {
+	var index = &xzIndexReader{input: r.input, crc: crc32.NewIEEE(), size: 1}
+	index.crc.Write([]byte{0})
+	count, err := binary.ReadUvarint(index)
+	if err != nil {
+		return err
+	}
+	if count != uint64(len(records)) {
+		return ErrXzIndex
+	}
+	for _, record := range records {
+		unpaddedSize, err := binary.ReadUvarint(index)
+		if err != nil {
+			return err
+		}
+		uncompressedSize, err := binary.ReadUvarint(index)
+		if err != nil {
+			return err
+		}
+		if unpaddedSize != record.unpaddedSize || uncompressedSize != record.uncompressedSize {
+			return ErrXzIndex
+		}
+	}
+	for index.size%4 != 0 {
+		if padding, err := index.ReadByte(); err != nil {
+			return err
+		} else if padding != 0 {
+			return ErrXzIndex
+		}
+	}
+
+	// CRC32 of the index, then the footer: CRC32, backward size, stream
+	// flags and magic
+	var tail = make([]byte, 4+xzStreamFooterSize)
+	if _, err := io.ReadFull(r.input, tail); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	var footer = tail[4:]
+	if binary.LittleEndian.Uint32(tail) != index.crc.Sum32() ||
+		binary.LittleEndian.Uint32(footer) != crc32.ChecksumIEEE(footer[4:10]) ||
+		int64(binary.LittleEndian.Uint32(footer[4:])) != index.size/4 ||
+		!bytes.Equal(footer[8:10], r.header[6:8]) ||
+		string(footer[10:]) != "YZ" {
+		return ErrXzIndex
+	}
+	return nil
+}
+
+// xzIndexReader reads the index byte by byte, summing up its size and CRC32.
+type xzIndexReader struct {
+	input io.Reader
+	crc   hash.Hash32
+	size  int64
+}
+
+func (r *xzIndexReader) ReadByte() (byte, error) {
+	var b [1]byte
+	if _, err := io.ReadFull(r.input, b[:]); err != nil {
+		return 0, io.ErrUnexpectedEOF
+	}
+	r.crc.Write(b[:])
+	r.size++
+	return b[0], nil
+}
+
+// Read returns the first error met on every call after it.
+func (r *xzParallel) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	for {
+		switch {
+		case r.current == nil:
+		case r.current.serial != nil:
+			n, err := r.current.serial.Read(p)
+			if err == io.EOF {
+				close(r.current.consumed)
+				r.current = nil
+				if n == 0 {
+					continue
+				}
+				err = nil
+			}
+			r.err = err
+			return n, err
+		case len(r.current.data) != 0:
+			n := copy(p, r.current.data)
+			r.current.data = r.current.data[n:]
+			return n, nil
+		default:
+			r.release(int64(r.current.record.uncompressedSize))
+			r.current = nil
+		}
+		block, ok := <-r.order
+		if !ok {
+			r.err = io.EOF
+			return 0, r.err
+		}
+		<-block.done
+		if block.err != nil {
+			r.err = block.err
+			return 0, r.err
+		}
+		r.current = block
+	}
+}
+
+// Close stops the splitting and waits for the decoders running.
+func (r *xzParallel) Close() error {
+	r.lock.Lock()
+	r.stopped = true
+	r.lock.Unlock()
+	r.budget.Broadcast()
+	close(r.stop)
+	for block := range r.order {
+		<-block.done
+	}
+	return nil
+}
+
+// xzCheckSize returns the size of the integrity check after each block,
+// which is given by the check type in the stream flags.
+func xzCheckSize(flags byte) int {
+	var check = flags & 0x0f
+	if check == 0 {
+		return 0
+	}
+	return 4 << ((check - 1) / 3)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"math/rand"
+	"os/exec"
+	"testing"
+)
+
+// TestParallelXzDecompress decodes a stream of many blocks written by xz -T
+// and compares the result with the serial decoder.
+func TestParallelXzDecompress(t *testing.T) {
+	if _, err := exec.LookPath("xz"); err != nil {
+		t.Skip("xz not found")
+	}
+
+	// Compressible, but not so much that the blocks shrink to nothing
+	var plain = make([]byte, 4*1024*1024+123)
+	var random = rand.New(rand.NewSource(1))
+	for i := range plain {
+		plain[i] = "abcdefgh"[random.Intn(8)]
+	}
+	cmd := exec.Command("xz", "-T4", "--block-size=65536", "-c")
+	cmd.Stdin = bytes.NewReader(plain)
+	stream, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serial, err := XzDecompress(bytes.NewReader(stream))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := ioutil.ReadAll(serial)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A budget smaller than two blocks lets only one be in flight at a time
+	for _, budget := range []int64{XzParallelBudget, 65536} {
+		saved := XzParallelBudget
+		XzParallelBudget = budget
+		parallel, err := ParallelXzDecompress(bytes.NewReader(stream), 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(parallel)
+		parallel.Close()
+		XzParallelBudget = saved
+		if err != nil {
+			t.Fatalf("budget %d: %v", budget, err)
+		}
+		if !bytes.Equal(got, want) || !bytes.Equal(got, plain) {
+			t.Fatalf("budget %d: decoded %d bytes, differing from the serial decoder", budget, len(got))
+		}
+	}
+
+	// A truncated stream fails, on every read
+	parallel, err := ParallelXzDecompress(bytes.NewReader(stream[:len(stream)/2]), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer parallel.Close()
+	if _, err := ioutil.ReadAll(parallel); err == nil {
+		t.Fatal("truncated stream decoded without error")
+	}
+	if _, err := parallel.Read(make([]byte, 1)); err == nil {
+		t.Fatal("error not returned again")
+	}
+}
+
+// TestParallelXzBlocksWithoutSizes decodes a stream whose block headers
+// after the first one omit the sizes, which the xz format allows.
+func TestParallelXzBlocksWithoutSizes(t *testing.T) {
+	if _, err := exec.LookPath("xz"); err != nil {
+		t.Skip("xz not found")
+	}
+	var plain = make([]byte, 1024*1024+321)
+	var random = rand.New(rand.NewSource(2))
+	for i := range plain {
+		plain[i] = "abcdefgh"[random.Intn(8)]
+	}
+	cmd := exec.Command("xz", "-T4", "--block-size=65536", "-c")
+	cmd.Stdin = bytes.NewReader(plain)
+	stream, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream = xzDropSizes(stream)
+	cmd = exec.Command("xz", "-t")
+	cmd.Stdin = bytes.NewReader(stream)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("rewritten stream: %v: %s", err, out)
+	}
+
+	parallel, err := ParallelXzDecompress(bytes.NewReader(stream), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(parallel)
+	parallel.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plain) {
+		t.Fatalf("decoded %d bytes, differing from the input", len(got))
+	}
+
+	// Damage in the last block, which has no sizes
+	var damaged = append([]byte(nil), stream...)
+	damaged[len(damaged)-100] ^= 0x01
+	parallel, err = ParallelXzDecompress(bytes.NewReader(damaged), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer parallel.Close()
+	if _, err := ioutil.ReadAll(parallel); err == nil {
+		t.Fatal("damaged stream decoded without error")
+	}
+}
+
+// xzDropSizes rewrites the block headers after the first one of a stream
+// of LZMA2 blocks without their sizes, and the index and the footer to
+// match.
+func xzDropSizes(stream []byte) []byte {
+	var varint [binary.MaxVarintLen64]byte
+	appendUvarint := func(b []byte, value uint64) []byte {
+		return append(b, varint[:binary.PutUvarint(varint[:], value)]...)
+	}
+	appendUint32 := func(b []byte, value uint32) []byte {
+		var le [4]byte
+		binary.LittleEndian.PutUint32(le[:], value)
+		return append(b, le[:]...)
+	}
+	var checkSize = xzCheckSize(stream[7])
+	var out = append([]byte(nil), stream[:xzStreamHeaderSize]...)
+	var records []uint64
+	var pos = xzStreamHeaderSize
+	for stream[pos] != 0 {
+		var old = stream[pos : pos+(int(stream[pos])+1)*4]
+		compressed, n := binary.Uvarint(old[2:])
+		uncompressed, m := binary.Uvarint(old[2+n:])
+		var body = stream[pos+len(old) : pos+len(old)+int(compressed+3)&^3+checkSize]
+		var header = old
+		if pos != xzStreamHeaderSize {
+			// Flags, then filter ID, size of the properties and dictionary size
+			header = []byte{0, old[1] &^ (xzBlockHasCompSize | xzBlockHasUncompSize)}
+			header = append(header, old[2+n+m:2+n+m+3]...)
+			for len(header)%4 != 0 {
+				header = append(header, 0)
+			}
+			header[0] = byte(len(header) / 4) // of the header with its CRC32, less one
+			header = appendUint32(header, crc32.ChecksumIEEE(header))
+		}
+		out = append(append(out, header...), body...)
+		records = append(records, uint64(len(header))+compressed+uint64(checkSize), uncompressed)
+		pos += len(old) + len(body)
+	}
+
+	var index = []byte{0}
+	index = appendUvarint(index, uint64(len(records)/2))
+	for _, value := range records {
+		index = appendUvarint(index, value)
+	}
+	for len(index)%4 != 0 {
+		index = append(index, 0)
+	}
+	index = appendUint32(index, crc32.ChecksumIEEE(index))
+	out = append(out, index...)
+
+	var footer = make([]byte, 4, xzStreamFooterSize)
+	footer = appendUint32(footer, uint32(len(index)/4-1))
+	footer = append(footer, stream[6:8]...)
+	footer = append(footer, 'Y', 'Z')
+	binary.LittleEndian.PutUint32(footer, crc32.ChecksumIEEE(footer[4:10]))
+	return append(out, footer...)
+}